@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/opencontainers/go-digest"
+
+	"github.com/ricardomaraschini/tagbag/tgz"
+)
+
+// archiveEntry locates a file inside an archive.
+type archiveEntry struct {
+	archive *tgz.Archive
+	name    string
+}
+
+// archiveBlobs serves blobs straight out of tarballs, without extracting
+// them. It implements the storage.BlobSource interface.
+type archiveBlobs struct {
+	archives []*tgz.Archive
+	blobs    map[digest.Digest]archiveEntry
+}
+
+// GetBlob returns a reader for the blob with the provided digest. Returns
+// an error satisfying os.IsNotExist if none of the archives has the blob.
+func (a *archiveBlobs) GetBlob(dgst digest.Digest) (io.ReadCloser, int64, error) {
+	entry, ok := a.blobs[dgst]
+	if !ok {
+		return nil, -1, &os.PathError{Op: "open", Path: dgst.String(), Err: os.ErrNotExist}
+	}
+	return entry.archive.OpenFile(entry.name)
+}
+
+// Close closes all archives.
+func (a *archiveBlobs) Close() error {
+	for _, archive := range a.archives {
+		if err := archive.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// extractBundle makes the content of the provided tarballs available in the
+// target directory, tarballs are processed in order. For tarballs carrying
+// a table of contents only the metadata (manifests, signatures, etc) is
+// extracted, their blobs are served by the returned archiveBlobs. Tarballs
+// without a table of contents, and encrypted ones, are extracted entirely
+// (decrypted with opts). Callers must close the returned archiveBlobs.
+func extractBundle(target string, opts []tgz.Option, sources ...string) (*archiveBlobs, error) {
+	blobs := &archiveBlobs{blobs: map[digest.Digest]archiveEntry{}}
+	metadata := tgz.WithFilter(func(name string) bool {
+		return !blobRegexp.MatchString(path.Base(name))
+	})
+	for _, source := range sources {
+		archive, err := tgz.Open(source)
+		if err != nil {
+			if !errors.Is(err, tgz.ErrNotSeekable) {
+				blobs.Close()
+				return nil, fmt.Errorf("failed to open %s: %w", source, err)
+			}
+			fmt.Println("Extracting", source)
+			if err := tgz.Uncompress(source, target, opts...); err != nil {
+				blobs.Close()
+				return nil, fmt.Errorf("failed to uncompress %s: %w", source, err)
+			}
+			continue
+		}
+		blobs.archives = append(blobs.archives, archive)
+		fmt.Println("Extracting metadata from", source)
+		if err := archive.Extract(target, append(opts, metadata)...); err != nil {
+			blobs.Close()
+			return nil, fmt.Errorf("failed to extract %s: %w", source, err)
+		}
+		for _, entry := range archive.Entries() {
+			base := path.Base(entry.Name)
+			if !blobRegexp.MatchString(base) {
+				continue
+			}
+			dgst := digest.NewDigestFromEncoded(digest.SHA256, base)
+			blobs.blobs[dgst] = archiveEntry{archive: archive, name: entry.Name}
+		}
+	}
+	return blobs, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+// attachmentSuffixes are the suffixes of the tags, derived from the image
+// digest, cosign keeps signatures (.sig), attestations (.att) and SBOMs
+// (.sbom) attached to an image under.
+var attachmentSuffixes = []string{".sig", ".att", ".sbom"}
+
+// referrersSuffix is the suffix of the tag, derived from the image digest,
+// holding the referrers index of the image in registries lacking the OCI
+// referrers API.
+const referrersSuffix = ""
+
+// attachmentTag returns the tag artifacts attached to the manifest with the
+// provided digest are stored under.
+func attachmentTag(dgst digest.Digest, suffix string) string {
+	return fmt.Sprintf("%s-%s%s", dgst.Algorithm(), dgst.Encoded(), suffix)
+}
+
+// attachmentSources returns the artifacts attached to the manifest, with
+// digest dgst, of the image pulled from src. Only images pulled from
+// registries have attachments. Referrers are listed through the OCI
+// referrers API and named after the image with the tag replaced by their
+// digest. Registries lacking the API keep the referrers index under a tag
+// instead. This tag, as well as the cosign tags, are named after the image
+// with the tag replaced by the attachment tag. Tags that can't be read are
+// considered absent while failing to list referrers, for any other reason
+// than the registry lacking the API, is an error.
+func attachmentSources(
+	ctx context.Context, src pullSource, dgst digest.Digest, sys *types.SystemContext,
+) ([]pullSource, error) {
+	remote := src.ref.DockerReference()
+	if src.ref.Transport().Name() != transportDocker || remote == nil {
+		return nil, nil
+	}
+	local, err := reference.ParseNormalizedNamed(src.name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name %s: %w", src.name, err)
+	}
+	var sources []pullSource
+	suffixes := attachmentSuffixes
+	referrers, err := listReferrers(ctx, reference.TrimNamed(remote), dgst, sys)
+	if err != nil {
+		// failing to list referrers would silently drop them, only
+		// registries lacking the api fall back to the referrers tag.
+		if !errors.Is(err, errReferrersUnsupported) {
+			return nil, fmt.Errorf("failed to list referrers of %s: %w", src.name, err)
+		}
+		suffixes = append(suffixes[:len(suffixes):len(suffixes)], referrersSuffix)
+	}
+	for _, referrer := range referrers {
+		pinned, err := reference.WithDigest(reference.TrimNamed(remote), referrer.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid referrer digest %s: %w", referrer.Digest, err)
+		}
+		ref, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", pinned))
+		if err != nil {
+			return nil, fmt.Errorf("failed parse %s transport: %w", pinned, err)
+		}
+		name, err := reference.WithDigest(reference.TrimNamed(local), referrer.Digest)
+		if err != nil {
+			return nil, fmt.Errorf("invalid referrer digest %s: %w", referrer.Digest, err)
+		}
+		sources = append(sources, pullSource{
+			name:   reference.FamiliarString(name),
+			ref:    ref,
+			pinned: true,
+		})
+	}
+	for _, suffix := range suffixes {
+		tag := attachmentTag(dgst, suffix)
+		tagged, err := reference.WithTag(reference.TrimNamed(remote), tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attachment tag %s: %w", tag, err)
+		}
+		ref, err := alltransports.ParseImageName(fmt.Sprintf("docker://%s", tagged))
+		if err != nil {
+			return nil, fmt.Errorf("failed parse %s transport: %w", tagged, err)
+		}
+		if !attachmentExists(ctx, ref, sys) {
+			continue
+		}
+		name, err := reference.WithTag(reference.TrimNamed(local), tag)
+		if err != nil {
+			return nil, fmt.Errorf("invalid attachment tag %s: %w", tag, err)
+		}
+		sources = append(sources, pullSource{name: reference.FamiliarString(name), ref: ref})
+	}
+	return sources, nil
+}
+
+// attachmentExists returns true if the image referred by ref can be read.
+// Missing tags cause the source to fail to open.
+func attachmentExists(ctx context.Context, ref types.ImageReference, sys *types.SystemContext) bool {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return false
+	}
+	defer src.Close()
+	_, _, err = src.GetManifest(ctx, nil)
+	return err == nil
+}
+
+// pullAttachments pulls the signatures, attestations and other artifacts
+// attached to image, pulled from src, into the provided storage. Only the
+// artifacts attached to the stored manifest are pulled, e.g. when a single
+// instance of a manifest list is pulled the artifacts attached to it are
+// pulled instead of the ones attached to the list. The claim function is
+// called before pulling each attachment and must return false if it has
+// already been pulled. Attachments are not signed themselves, they are not
+// checked against the signature policy but found through the digest of
+// their subject, verified as it was pulled.
+func pullAttachments(
+	ctx context.Context,
+	store *storage.Storage,
+	src pullSource,
+	image storage.IndexImage,
+	opts *copy.Options,
+	claim func(string) bool,
+) ([]storage.IndexImage, error) {
+	sources, err := attachmentSources(ctx, src, image.Digest, opts.SourceCtx)
+	if err != nil {
+		return nil, err
+	}
+	// attachments are artifacts, not images, and are kept untouched.
+	all := *opts
+	all.ImageListSelection = copy.CopyAllImages
+	var attachments []storage.IndexImage
+	for _, source := range sources {
+		if !claim(source.name) {
+			continue
+		}
+		fmt.Println("Pulling", source.name)
+		attachment, err := pullImage(ctx, store, source, nil, "", &all)
+		if err != nil {
+			return nil, err
+		}
+		attachment.Subject = src.name
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// attachmentDestination returns the name the attachment stored as image
+// should be pushed as. Attachments are pushed, with their tag, to the
+// repository their subject is pushed to, dst being the name the subject is
+// pushed as. Referrers, stored by digest, are pushed by digest and found
+// by registries implementing the OCI referrers API through their subject.
+func attachmentDestination(image, dst string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid attachment %s: %w", image, err)
+	}
+	repo, _, _ := strings.Cut(dst, "@")
+	if idx := strings.LastIndex(repo, ":"); idx > strings.LastIndex(repo, "/") {
+		repo = repo[:idx]
+	}
+	var result string
+	switch named := named.(type) {
+	case reference.NamedTagged:
+		result = fmt.Sprintf("%s:%s", repo, named.Tag())
+	case reference.Canonical:
+		result = fmt.Sprintf("%s@%s", repo, named.Digest())
+	default:
+		return "", fmt.Errorf("attachment %s has neither tag nor digest", image)
+	}
+	if _, err := reference.ParseNormalizedNamed(result); err != nil {
+		return "", fmt.Errorf("invalid destination %s for %s: %w", result, image, err)
+	}
+	return result, nil
+}
+
+// attachmentSubjects returns the subject of each attachment stored in the
+// provided storage, as recorded in its index, indexed by attachment name.
+// Bundles without index have no attachments.
+func attachmentSubjects(store *storage.Storage) (map[string]string, error) {
+	subjects := map[string]string{}
+	index, err := store.ReadIndex()
+	if err != nil {
+		if errors.Is(err, storage.ErrNoIndex) {
+			return subjects, nil
+		}
+		return nil, err
+	}
+	for _, image := range index.Images {
+		if image.Subject != "" {
+			subjects[image.Reference] = image.Subject
+		}
+	}
+	return subjects, nil
+}
+
+// verifiedAttachments returns, among the provided attachments mapped to their
+// subjects, the ones proven to be attached to their subject. The subject an
+// attachment is recorded with comes from the bundle index, which is not
+// trusted, so the attachment must also be bound to the digest of the stored
+// subject: tagged attachments must carry the tag derived from it (see
+// attachmentTag) and referrers, stored by digest, must refer to it through
+// their subject.
+func verifiedAttachments(
+	ctx context.Context, store *storage.Storage, subjects map[string]string,
+) (map[string]bool, error) {
+	verified := map[string]bool{}
+	for attachment, subject := range subjects {
+		dgst, err := store.ManifestDigest(ctx, subject)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", subject, err)
+		}
+		if verified[attachment], err = attachedTo(ctx, store, attachment, dgst); err != nil {
+			return nil, err
+		}
+	}
+	return verified, nil
+}
+
+// attachedTo returns true if the provided attachment is attached to the
+// manifest with digest dgst. The tag of tagged attachments must be one of
+// the tags derived from dgst while attachments stored by digest must be
+// referrers whose subject is dgst.
+func attachedTo(
+	ctx context.Context, store *storage.Storage, attachment string, dgst digest.Digest,
+) (bool, error) {
+	named, err := reference.ParseNormalizedNamed(attachment)
+	if err != nil {
+		return false, fmt.Errorf("invalid attachment %s: %w", attachment, err)
+	}
+	switch named := named.(type) {
+	case reference.NamedTagged:
+		suffixes := attachmentSuffixes[:len(attachmentSuffixes):len(attachmentSuffixes)]
+		for _, suffix := range append(suffixes, referrersSuffix) {
+			if named.Tag() == attachmentTag(dgst, suffix) {
+				return true, nil
+			}
+		}
+		return false, nil
+	case reference.Canonical:
+		raw, _, err := store.Manifest(ctx, attachment)
+		if err != nil {
+			return false, fmt.Errorf("failed to read %s: %w", attachment, err)
+		}
+		if digest.FromBytes(raw) != named.Digest() {
+			return false, nil
+		}
+		var referrer struct {
+			Subject *storage.OCIDescriptor `json:"subject"`
+		}
+		if err := json.Unmarshal(raw, &referrer); err != nil {
+			return false, nil
+		}
+		return referrer.Subject != nil && referrer.Subject.Digest == dgst, nil
+	}
+	return false, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAttachmentDestination(t *testing.T) {
+	dgst := digest.FromString("app")
+	sig := attachmentTag(dgst, ".sig")
+	for _, tt := range []struct {
+		name  string
+		image string
+		dst   string
+		ref   string
+		err   string
+	}{
+		{
+			name:  "tagged",
+			image: "quay.io/org/app:" + sig,
+			dst:   "registry.local/org/app:1",
+			ref:   "registry.local/org/app:" + sig,
+		},
+		{
+			name:  "pinned",
+			image: "quay.io/org/app:" + sig,
+			dst:   "registry.local/org/app@" + dgst.String(),
+			ref:   "registry.local/org/app:" + sig,
+		},
+		{
+			name:  "pinned and tagged",
+			image: "quay.io/org/app:" + sig,
+			dst:   "registry.local/org/app:1@" + dgst.String(),
+			ref:   "registry.local/org/app:" + sig,
+		},
+		{
+			name:  "registry with port",
+			image: "quay.io/org/app:" + sig,
+			dst:   "localhost:5000/app",
+			ref:   "localhost:5000/app:" + sig,
+		},
+		{
+			name:  "no registry host",
+			image: "app:" + attachmentTag(dgst, ""),
+			dst:   "app:1",
+			ref:   "app:" + attachmentTag(dgst, ""),
+		},
+		{
+			name:  "referrer",
+			image: "quay.io/org/app@" + dgst.String(),
+			dst:   "registry.local/org/app:1",
+			ref:   "registry.local/org/app@" + dgst.String(),
+		},
+		{
+			name:  "referrer of pinned image",
+			image: "quay.io/org/app@" + dgst.String(),
+			dst:   "registry.local/org/app@" + digest.FromString("subject").String(),
+			ref:   "registry.local/org/app@" + dgst.String(),
+		},
+		{
+			name:  "attachment without tag nor digest",
+			image: "quay.io/org/app",
+			dst:   "registry.local/org/app:1",
+			err:   "attachment quay.io/org/app has neither tag nor digest",
+		},
+		{
+			name:  "invalid attachment",
+			image: "quay.io/org/app 1",
+			dst:   "registry.local/org/app:1",
+			err:   "invalid attachment quay.io/org/app 1",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := attachmentDestination(tt.image, tt.dst)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.ref, ref)
+		})
+	}
+}
+
+func TestAttachmentTag(t *testing.T) {
+	dgst := digest.FromString("app")
+	assert.Equal(t, "sha256-"+dgst.Encoded()+".sig", attachmentTag(dgst, ".sig"))
+	assert.Equal(t, "sha256-"+dgst.Encoded(), attachmentTag(dgst, ""))
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/manifest"
+
+	"github.com/ricardomaraschini/tagbag/platform"
+	"github.com/ricardomaraschini/tagbag/storage"
+	"github.com/ricardomaraschini/tagbag/tgz"
+)
+
+var (
+	blobRegexp     = regexp.MustCompile(`^[a-f0-9]{64}$`)
+	instanceRegexp = regexp.MustCompile(`^([a-f0-9]{64})\.manifest\.json$`)
+)
+
+// maxConfigSize is the maximum size of a blob we keep in memory while
+// scanning a tarball. Config blobs are small json documents and we need
+// them to figure out the image platform.
+const maxConfigSize = 1 << 20
+
+// bundleImage holds the information about a single image found in a tarball.
+type bundleImage struct {
+	Name      string        `json:"name"`
+	Digest    digest.Digest `json:"digest"`
+	Platforms []string      `json:"platforms"`
+	Layers    int           `json:"layers"`
+	Size      int64         `json:"size"`
+	blobs     []digest.Digest
+	missing   []digest.Digest
+}
+
+// bundleScanner collects, while streaming through a tarball, everything we
+// need to know about the images stored in it. Blobs are not kept in memory,
+// only their sizes, with the exception of small json blobs (configs). If
+// verify is set the content of blobs and child manifests is checked against
+// the digest encoded in their file names. The raw index, as it is signed,
+// and its embedded signature are kept in rawIndex and signature. Tarballs
+// are read with opts (e.g. to decrypt them).
+type bundleScanner struct {
+	verify     bool
+	opts       []tgz.Option
+	index      *storage.Index
+	rawIndex   []byte
+	signature  []byte
+	ociIndex   *storage.OCIIndex
+	references map[string]string
+	manifests  map[string][]byte
+	instances  map[string]map[string][]byte
+	configs    map[digest.Digest][]byte
+	blobs      map[digest.Digest]int64
+	corrupt    map[string]digest.Digest
+}
+
+// newBundleScanner returns an empty bundleScanner.
+func newBundleScanner() *bundleScanner {
+	return &bundleScanner{
+		references: map[string]string{},
+		manifests:  map[string][]byte{},
+		instances:  map[string]map[string][]byte{},
+		configs:    map[digest.Digest][]byte{},
+		blobs:      map[digest.Digest]int64{},
+		corrupt:    map[string]digest.Digest{},
+	}
+}
+
+// scan streams through the provided tarball.
+func (b *bundleScanner) scan(source string) error {
+	return tgz.Walk(source, b.entry, b.opts...)
+}
+
+// entry processes a single tarball entry. This function is meant to be used
+// as a tgz.WalkFunc.
+func (b *bundleScanner) entry(header *tar.Header, content io.Reader) error {
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+	name := path.Clean(header.Name)
+	if name == storage.IndexPath {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("failed to read index: %w", err)
+		}
+		var index storage.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return fmt.Errorf("failed to parse index: %w", err)
+		}
+		b.index = &index
+		b.rawIndex = data
+		return nil
+	}
+	if name == storage.IndexSignaturePath {
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("failed to read index signature: %w", err)
+		}
+		b.signature = data
+		return nil
+	}
+	if name == storage.OCIIndexFile {
+		var index storage.OCIIndex
+		if err := json.NewDecoder(content).Decode(&index); err != nil {
+			return fmt.Errorf("failed to parse oci index: %w", err)
+		}
+		b.ociIndex = &index
+		return nil
+	}
+	dir, base := path.Split(name)
+	dir = path.Clean(dir)
+	if strings.HasPrefix(dir, ".") && dir != "." {
+		return nil
+	}
+	switch {
+	case base == storage.ReferenceFile && path.Dir(dir) == storage.ImagesDir:
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		b.references[dir] = string(data)
+	case base == "manifest.json":
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		b.manifests[dir] = data
+	case instanceRegexp.MatchString(base):
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		if _, ok := b.instances[dir]; !ok {
+			b.instances[dir] = map[string][]byte{}
+		}
+		hex := instanceRegexp.FindStringSubmatch(base)[1]
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, hex)
+		if b.verify && digest.FromBytes(data) != dgst {
+			b.corrupt[name] = dgst
+			return nil
+		}
+		b.instances[dir][hex] = data
+	case blobRegexp.MatchString(base):
+		dgst := digest.NewDigestFromEncoded(digest.SHA256, base)
+		b.blobs[dgst] = header.Size
+		var verifier digest.Verifier
+		if b.verify {
+			verifier = dgst.Verifier()
+			content = io.TeeReader(content, verifier)
+		}
+		if header.Size > maxConfigSize {
+			if verifier == nil {
+				return nil
+			}
+			if _, err := io.Copy(io.Discard, content); err != nil {
+				return fmt.Errorf("failed to read %s: %w", header.Name, err)
+			}
+			if !verifier.Verified() {
+				b.corrupt[name] = dgst
+			}
+			return nil
+		}
+		data, err := io.ReadAll(content)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		if verifier != nil && !verifier.Verified() {
+			b.corrupt[name] = dgst
+			return nil
+		}
+		if len(data) > 0 && data[0] == '{' {
+			b.configs[dgst] = data
+		}
+	}
+	return nil
+}
+
+// images returns all images found in the tarball sorted by name. Images
+// without a reference file, not completely written, are skipped. Images in
+// bundles using the OCI image layout format are read from the layout index,
+// images without a reference name annotation are skipped.
+func (b *bundleScanner) images() ([]bundleImage, error) {
+	var images []bundleImage
+	for dir, raw := range b.manifests {
+		name, ok := b.references[dir]
+		if !ok {
+			if path.Dir(dir) == storage.ImagesDir {
+				continue
+			}
+			name = storage.ImageFromLegacyPath(dir)
+		}
+		image, err := b.image(name, raw, func(dgst digest.Digest) ([]byte, bool) {
+			raw, ok := b.instances[dir][dgst.Encoded()]
+			return raw, ok
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to process %s: %w", dir, err)
+		}
+		images = append(images, image)
+	}
+	if b.ociIndex != nil {
+		for _, descriptor := range b.ociIndex.Manifests {
+			name, ok := descriptor.Annotations[storage.AnnotationRefName]
+			if !ok {
+				continue
+			}
+			raw, ok := b.configs[descriptor.Digest]
+			if !ok {
+				images = append(images, bundleImage{
+					Name:    name,
+					Digest:  descriptor.Digest,
+					missing: []digest.Digest{descriptor.Digest},
+				})
+				continue
+			}
+			image, err := b.image(name, raw, func(dgst digest.Digest) ([]byte, bool) {
+				raw, ok := b.configs[dgst]
+				return raw, ok
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to process %s: %w", name, err)
+			}
+			images = append(images, image)
+		}
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Name < images[j].Name
+	})
+	return images, nil
+}
+
+// image processes the provided top level manifest of the image with the
+// provided name. Manifests of manifest list instances are obtained through
+// the lookup function.
+func (b *bundleScanner) image(
+	name string, raw []byte, lookup func(digest.Digest) ([]byte, bool),
+) (bundleImage, error) {
+	dgst, err := manifest.Digest(raw)
+	if err != nil {
+		return bundleImage{}, fmt.Errorf("failed to digest manifest: %w", err)
+	}
+	image := bundleImage{Name: name, Digest: dgst}
+	sizes := map[digest.Digest]int64{}
+	layers := map[digest.Digest]bool{}
+	addmanifest := func(raw []byte) (*platform.Platform, error) {
+		man, err := manifest.FromBlob(raw, manifest.GuessMIMEType(raw))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse manifest: %w", err)
+		}
+		for _, layer := range man.LayerInfos() {
+			layers[layer.Digest] = true
+			sizes[layer.Digest] = layer.Size
+		}
+		config := man.ConfigInfo()
+		if config.Digest == "" {
+			return nil, nil
+		}
+		sizes[config.Digest] = config.Size
+		data, ok := b.configs[config.Digest]
+		if !ok {
+			return nil, nil
+		}
+		var described platform.Platform
+		if err := json.Unmarshal(data, &described); err != nil {
+			return nil, fmt.Errorf("failed to parse config: %w", err)
+		}
+		return &described, nil
+	}
+	if !manifest.MIMETypeIsMultiImage(manifest.GuessMIMEType(raw)) {
+		described, err := addmanifest(raw)
+		if err != nil {
+			return bundleImage{}, err
+		}
+		if described != nil {
+			image.Platforms = []string{described.String()}
+		}
+	} else {
+		var list struct {
+			Manifests []struct {
+				Digest   digest.Digest      `json:"digest"`
+				Platform *platform.Platform `json:"platform"`
+			} `json:"manifests"`
+		}
+		if err := json.Unmarshal(raw, &list); err != nil {
+			return bundleImage{}, fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+		for _, instance := range list.Manifests {
+			raw, ok := lookup(instance.Digest)
+			if !ok {
+				image.missing = append(image.missing, instance.Digest)
+				continue
+			}
+			described, err := addmanifest(raw)
+			if err != nil {
+				return bundleImage{}, err
+			}
+			if instance.Platform != nil {
+				described = instance.Platform
+			}
+			if described != nil {
+				image.Platforms = append(image.Platforms, described.String())
+			}
+		}
+	}
+	image.Layers = len(layers)
+	for dgst, size := range sizes {
+		image.Size += size
+		image.blobs = append(image.blobs, dgst)
+	}
+	return image, nil
+}
+
+// size returns the sum of the sizes of all blobs stored in the tarball.
+// As blobs are deduplicated this is the deduplicated size of all images.
+func (b *bundleScanner) size() int64 {
+	var total int64
+	for _, size := range b.blobs {
+		total += size
+	}
+	return total
+}
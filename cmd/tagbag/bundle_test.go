@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ricardomaraschini/tagbag/platform"
+	"github.com/ricardomaraschini/tagbag/storage"
+	"github.com/ricardomaraschini/tagbag/tgz"
+)
+
+// testImage holds the blobs of a single platform image used to build test
+// tarballs.
+type testImage struct {
+	config   []byte
+	layer    []byte
+	manifest []byte
+}
+
+// newTestImage returns a single platform image for the provided platform.
+func newTestImage(t *testing.T, system, arch string) testImage {
+	config, err := json.Marshal(platform.Platform{OS: system, Architecture: arch})
+	assert.NoError(t, err)
+	layer := []byte("layer " + system + "/" + arch)
+	manifest, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"config": map[string]any{
+			"mediaType": "application/vnd.oci.image.config.v1+json",
+			"digest":    digest.FromBytes(config),
+			"size":      len(config),
+		},
+		"layers": []map[string]any{{
+			"mediaType": "application/vnd.oci.image.layer.v1.tar",
+			"digest":    digest.FromBytes(layer),
+			"size":      len(layer),
+		}},
+	})
+	assert.NoError(t, err)
+	return testImage{config: config, layer: layer, manifest: manifest}
+}
+
+// blobs returns the config and the layer of the image keyed by their paths
+// inside the provided directory.
+func (i testImage) blobs(dir string) map[string][]byte {
+	return map[string][]byte{
+		path.Join(dir, digest.FromBytes(i.config).Encoded()): i.config,
+		path.Join(dir, digest.FromBytes(i.layer).Encoded()):  i.layer,
+	}
+}
+
+// writeBundle writes files, keyed by their relative paths, into a temporary
+// directory and compresses it into a tarball whose path is returned.
+func writeBundle(t *testing.T, files map[string][]byte) string {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(tmpdir) })
+	source := path.Join(tmpdir, "bundle")
+	for fpath, data := range files {
+		fpath = path.Join(source, fpath)
+		assert.NoError(t, os.MkdirAll(path.Dir(fpath), 0755))
+		assert.NoError(t, os.WriteFile(fpath, data, 0644))
+	}
+	target := path.Join(tmpdir, "bundle.tgz")
+	assert.NoError(t, tgz.Compress(source, target))
+	return target
+}
+
+// hashedBundle returns the files of a bundle holding app:1, a manifest list
+// with two instances, stored in the hashed layout.
+func hashedBundle(t *testing.T) map[string][]byte {
+	amd64 := newTestImage(t, "linux", "amd64")
+	arm64 := newTestImage(t, "linux", "arm64")
+	list, err := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests": []map[string]any{{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    digest.FromBytes(amd64.manifest),
+			"size":      len(amd64.manifest),
+			"platform":  platform.Platform{OS: "linux", Architecture: "amd64"},
+		}, {
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    digest.FromBytes(arm64.manifest),
+			"size":      len(arm64.manifest),
+			"platform":  platform.Platform{OS: "linux", Architecture: "arm64"},
+		}},
+	})
+	assert.NoError(t, err)
+	dir := storage.ImagePath("app:1")
+	files := map[string][]byte{
+		path.Join(dir, storage.ReferenceFile):                                       []byte("app:1"),
+		path.Join(dir, "manifest.json"):                                             list,
+		path.Join(dir, digest.FromBytes(amd64.manifest).Encoded()+".manifest.json"): amd64.manifest,
+		path.Join(dir, digest.FromBytes(arm64.manifest).Encoded()+".manifest.json"): arm64.manifest,
+	}
+	for _, image := range []testImage{amd64, arm64} {
+		for fpath, data := range image.blobs(path.Join(storage.BlobsDir, "sha256")) {
+			files[fpath] = data
+		}
+	}
+	return files
+}
+
+// scanBundle scans the provided tarball and returns the scanner along with
+// the images found.
+func scanBundle(t *testing.T, source string, verify bool) (*bundleScanner, []bundleImage) {
+	scanner := newBundleScanner()
+	scanner.verify = verify
+	assert.NoError(t, scanner.scan(source))
+	images, err := scanner.images()
+	assert.NoError(t, err)
+	return scanner, images
+}
+
+func TestBundleScannerLegacy(t *testing.T) {
+	image := newTestImage(t, "linux", "amd64")
+	dir := storage.LegacyImagePath("app:1")
+	files := image.blobs(dir)
+	files[path.Join(dir, "manifest.json")] = image.manifest
+	source := writeBundle(t, files)
+
+	scanner, images := scanBundle(t, source, false)
+	assert.Equal(t, []bundleImage{{
+		Name:      "app:1",
+		Digest:    digest.FromBytes(image.manifest),
+		Platforms: []string{"linux/amd64"},
+		Layers:    1,
+		Size:      int64(len(image.config) + len(image.layer)),
+	}}, stripBlobs(images))
+	assert.Equal(t, int64(len(image.config)+len(image.layer)), scanner.size())
+}
+
+func TestBundleScannerHashed(t *testing.T) {
+	files := hashedBundle(t)
+	// an image without reference file was not completely written.
+	partial := newTestImage(t, "linux", "s390x")
+	files[path.Join(storage.ImagePath("partial:1"), "manifest.json")] = partial.manifest
+	source := writeBundle(t, files)
+
+	_, images := scanBundle(t, source, false)
+	assert.Len(t, images, 1)
+	assert.Equal(t, "app:1", images[0].Name)
+	assert.Equal(t, digest.FromBytes(files[path.Join(storage.ImagePath("app:1"), "manifest.json")]), images[0].Digest)
+	assert.Equal(t, []string{"linux/amd64", "linux/arm64"}, images[0].Platforms)
+	assert.Equal(t, 2, images[0].Layers)
+	assert.Len(t, images[0].blobs, 4)
+	assert.Empty(t, images[0].missing)
+}
+
+func TestBundleScannerOCILayout(t *testing.T) {
+	image := newTestImage(t, "linux", "amd64")
+	blobs := path.Join(storage.BlobsDir, "sha256")
+	files := image.blobs(blobs)
+	files[path.Join(blobs, digest.FromBytes(image.manifest).Encoded())] = image.manifest
+	missing := digest.FromString("missing")
+	index, err := json.Marshal(storage.OCIIndex{
+		SchemaVersion: 2,
+		Manifests: []storage.OCIDescriptor{{
+			MediaType:   "application/vnd.oci.image.manifest.v1+json",
+			Digest:      digest.FromBytes(image.manifest),
+			Size:        int64(len(image.manifest)),
+			Annotations: map[string]string{storage.AnnotationRefName: "quay.io/org/app:1"},
+		}, {
+			MediaType:   "application/vnd.oci.image.manifest.v1+json",
+			Digest:      missing,
+			Annotations: map[string]string{storage.AnnotationRefName: "quay.io/org/gone:1"},
+		}, {
+			// descriptors without the annotation are ignored.
+			MediaType: "application/vnd.oci.image.manifest.v1+json",
+			Digest:    digest.FromBytes(image.manifest),
+		}},
+	})
+	assert.NoError(t, err)
+	files[storage.OCIIndexFile] = index
+	files[storage.OCILayoutFile] = []byte(`{"imageLayoutVersion":"1.0.0"}`)
+	source := writeBundle(t, files)
+
+	_, images := scanBundle(t, source, false)
+	assert.Equal(t, []bundleImage{{
+		Name:      "quay.io/org/app:1",
+		Digest:    digest.FromBytes(image.manifest),
+		Platforms: []string{"linux/amd64"},
+		Layers:    1,
+		Size:      int64(len(image.config) + len(image.layer)),
+	}, {
+		Name:    "quay.io/org/gone:1",
+		Digest:  missing,
+		missing: []digest.Digest{missing},
+	}}, stripBlobs(images))
+}
+
+// stripBlobs clears the blobs of the provided images, their order is not
+// deterministic.
+func stripBlobs(images []bundleImage) []bundleImage {
+	for i := range images {
+		images[i].blobs = nil
+	}
+	return images
+}
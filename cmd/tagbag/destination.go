@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports/alltransports"
+
+	"github.com/ricardomaraschini/tagbag/mapping"
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+// Path modes define how the name of an image stored in a bundle is turned
+// into a repository path under the push destination.
+const (
+	// pathModeBasename keeps only the last path component of the image
+	// name, "quay.io/org/app:1" becomes "app:1".
+	pathModeBasename = "basename"
+	// pathModeStripRegistry removes the registry from the image name,
+	// "quay.io/org/app:1" becomes "org/app:1".
+	pathModeStripRegistry = "strip-registry"
+	// pathModeFull keeps the image name as is, "quay.io/org/app:1" is
+	// pushed to "quay.io/org/app:1" under the destination.
+	pathModeFull = "full"
+)
+
+// destinationPath returns the path, relative to the push destination, the
+// image should be pushed to according to mode.
+func destinationPath(image, mode string) (string, error) {
+	switch mode {
+	case pathModeBasename:
+		return image[strings.LastIndex(image, "/")+1:], nil
+	case pathModeStripRegistry:
+		registry, remainder, found := strings.Cut(image, "/")
+		if found && isRegistry(registry) {
+			return remainder, nil
+		}
+		return image, nil
+	case pathModeFull:
+		return image, nil
+	default:
+		return "", fmt.Errorf("unknown path mode %q", mode)
+	}
+}
+
+// destinationReference returns the name the image should be pushed as.
+// If rules is not nil and any of its rules matches the image the rewritten
+// name is used as is, otherwise the name is computed according to mode and
+// placed under the target location for registries. The returned name is
+// validated.
+func destinationReference(
+	image string, target pushTarget, mode string, rules *mapping.Mapping,
+) (string, error) {
+	var dst string
+	if mapped, ok := rules.Apply(image); ok {
+		dst = mapped
+	} else if target.transport == transportDocker && target.location == "" {
+		return "", fmt.Errorf("no mapping rule matches %s", image)
+	} else {
+		dstpath, err := destinationPath(image, mode)
+		if err != nil {
+			return "", err
+		}
+		dst = dstpath
+		if target.transport == transportDocker {
+			dst = fmt.Sprintf("%s/%s", target.location, dstpath)
+		}
+	}
+	if _, err := reference.ParseNormalizedNamed(dst); err != nil {
+		return "", fmt.Errorf("invalid destination %s for %s: %w", dst, image, err)
+	}
+	return dst, nil
+}
+
+// Transports images can be pushed to.
+const (
+	transportDocker            = "docker"
+	transportContainersStorage = "containers-storage"
+	transportDockerDaemon      = "docker-daemon"
+	transportOCI               = "oci"
+	transportDir               = "dir"
+)
+
+// pushTarget is where images are pushed to. Location is the registry (and
+// optionally namespace) for the docker transport, the path for the oci and
+// dir transports and the optional store specification ("[driver@root]")
+// for the containers-storage transport.
+type pushTarget struct {
+	transport string
+	location  string
+}
+
+// parseTarget parses the push destination. Destinations without transport
+// prefix are registries.
+func parseTarget(destination string) (pushTarget, error) {
+	transport := alltransports.TransportFromImageName(destination)
+	if transport == nil {
+		return pushTarget{transport: transportDocker, location: destination}, nil
+	}
+	target := pushTarget{
+		transport: transport.Name(),
+		location:  strings.TrimPrefix(destination, transport.Name()+":"),
+	}
+	switch target.transport {
+	case transportDocker:
+		target.location = strings.TrimPrefix(target.location, "//")
+	case transportContainersStorage:
+	case transportDockerDaemon:
+		if target.location != "" {
+			return pushTarget{}, fmt.Errorf("%s destination does not take a location", target.transport)
+		}
+	case transportOCI, transportDir:
+		if target.location == "" {
+			return pushTarget{}, fmt.Errorf("%s destination requires a path", target.transport)
+		}
+	default:
+		return pushTarget{}, fmt.Errorf("unsupported destination transport %s", target.transport)
+	}
+	return target, nil
+}
+
+// reference returns the reference, including the transport, to push the
+// image with the provided name to. Images pushed to dir destinations are
+// stored each in its own subdirectory named after the image, with colons
+// and at signs replaced by underscores.
+func (p pushTarget) reference(name string) (string, error) {
+	switch p.transport {
+	case transportDocker:
+		return fmt.Sprintf("docker://%s", name), nil
+	case transportContainersStorage:
+		return fmt.Sprintf("%s:%s%s", p.transport, p.location, name), nil
+	case transportDockerDaemon:
+		if strings.Contains(name, "@") {
+			return "", fmt.Errorf("%s does not support digests, use --digest-tag", p.transport)
+		}
+		return fmt.Sprintf("%s:%s", p.transport, name), nil
+	case transportOCI:
+		return fmt.Sprintf("%s:%s:%s", p.transport, p.location, name), nil
+	case transportDir:
+		dirname := strings.NewReplacer(":", "_", "@", "_").Replace(name)
+		return fmt.Sprintf("%s:%s", p.transport, path.Join(p.location, dirname)), nil
+	}
+	return "", fmt.Errorf("unsupported destination transport %s", p.transport)
+}
+
+// imageListSelection returns which images of manifest lists are pushed.
+// All of them are pushed unless the transport does not support manifest
+// lists.
+func (p pushTarget) imageListSelection() copy.ImageListSelection {
+	if p.transport == transportDockerDaemon {
+		return copy.CopySystemImage
+	}
+	return copy.CopyAllImages
+}
+
+// keepsSignatures returns true if simple signing signatures can be pushed
+// along with the images.
+func (p pushTarget) keepsSignatures() bool {
+	return p.transport != transportOCI && p.transport != transportDockerDaemon
+}
+
+// keepsAttachments returns true if signatures, attestations and other
+// artifacts attached to images can be pushed. Local container storages only
+// hold runnable images.
+func (p pushTarget) keepsAttachments() bool {
+	return p.transport == transportDocker || p.transport == transportOCI || p.transport == transportDir
+}
+
+// pinDestination handles destinations carrying a digest. These are pushed
+// by the digest of the manifest stored for the image, with any tag removed
+// as the docker transport does not support references with both a tag and
+// a digest. If tag is provided the image is pushed with it instead. Other
+// destinations are returned unchanged.
+func pinDestination(
+	ctx context.Context, store *storage.Storage, image, dst, tag string,
+) (string, error) {
+	named, err := reference.ParseNormalizedNamed(dst)
+	if err != nil {
+		return "", fmt.Errorf("invalid destination %s for %s: %w", dst, image, err)
+	}
+	canonical, ok := named.(reference.Canonical)
+	if !ok {
+		return dst, nil
+	}
+	repo := reference.TrimNamed(canonical)
+	if tag != "" {
+		tagged, err := reference.WithTag(repo, tag)
+		if err != nil {
+			return "", fmt.Errorf("invalid tag %s: %w", tag, err)
+		}
+		return tagged.String(), nil
+	}
+	stored, err := store.ManifestDigest(ctx, image)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s manifest: %w", image, err)
+	}
+	if stored != canonical.Digest() {
+		fmt.Printf(
+			"Image %s is stored with digest %s, pushing it by this digest\n",
+			image, stored,
+		)
+	}
+	pinned, err := reference.WithDigest(repo, stored)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest %s: %w", stored, err)
+	}
+	return pinned.String(), nil
+}
+
+// printDestinations prints a table with the destination of each image.
+func printDestinations(images []string, destinations map[string]string) error {
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "SOURCE\tDESTINATION")
+	for _, image := range images {
+		fmt.Fprintf(writer, "%s\t%s\n", image, destinations[image])
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write destinations: %w", err)
+	}
+	return nil
+}
+
+// isRegistry returns true if the first component of an image name is a
+// registry address. This follows the same rules as docker: the component
+// is a registry if it contains a dot or a port or if it is "localhost".
+func isRegistry(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+// checkCollisions returns an error listing all destinations images are
+// mapped to by more than one image. Destinations maps image names to the
+// place they are going to be pushed to.
+func checkCollisions(destinations map[string]string) error {
+	images := map[string][]string{}
+	for image, dst := range destinations {
+		images[dst] = append(images[dst], image)
+	}
+	var collisions []string
+	for dst, sources := range images {
+		if len(sources) < 2 {
+			continue
+		}
+		sort.Strings(sources)
+		collisions = append(
+			collisions,
+			fmt.Sprintf("%s (from %s)", dst, strings.Join(sources, ", ")),
+		)
+	}
+	if len(collisions) == 0 {
+		return nil
+	}
+	sort.Strings(collisions)
+	return fmt.Errorf(
+		"multiple images map to the same destination: %s",
+		strings.Join(collisions, "; "),
+	)
+}
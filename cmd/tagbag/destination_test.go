@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+func TestDestinationPath(t *testing.T) {
+	for _, tt := range []struct {
+		image string
+		mode  string
+		path  string
+	}{
+		{"quay.io/org/app:1", pathModeBasename, "app:1"},
+		{"quay.io/org/team/app:1", pathModeBasename, "app:1"},
+		{"app:1", pathModeBasename, "app:1"},
+		{"quay.io/org/app@sha256:abc", pathModeBasename, "app@sha256:abc"},
+		{"quay.io/org/app:1", pathModeStripRegistry, "org/app:1"},
+		{"localhost/app:1", pathModeStripRegistry, "app:1"},
+		{"localhost:5000/org/app:1", pathModeStripRegistry, "org/app:1"},
+		{"org/app:1", pathModeStripRegistry, "org/app:1"},
+		{"app:1", pathModeStripRegistry, "app:1"},
+		{"quay.io/org/app:1", pathModeFull, "quay.io/org/app:1"},
+		{"app:1", pathModeFull, "app:1"},
+	} {
+		t.Run(tt.mode+" "+tt.image, func(t *testing.T) {
+			dstpath, err := destinationPath(tt.image, tt.mode)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.path, dstpath)
+		})
+	}
+
+	_, err := destinationPath("quay.io/org/app:1", "flat")
+	assert.EqualError(t, err, `unknown path mode "flat"`)
+}
+
+func TestDestinationReference(t *testing.T) {
+	registry := pushTarget{transport: transportDocker, location: "registry.local/mirror"}
+	for _, tt := range []struct {
+		name   string
+		image  string
+		target pushTarget
+		mode   string
+		dst    string
+		err    string
+	}{
+		{
+			name:   "registry basename",
+			image:  "quay.io/org/app:1",
+			target: registry,
+			mode:   pathModeBasename,
+			dst:    "registry.local/mirror/app:1",
+		},
+		{
+			name:   "registry full",
+			image:  "quay.io/org/app:1",
+			target: registry,
+			mode:   pathModeFull,
+			dst:    "registry.local/mirror/quay.io/org/app:1",
+		},
+		{
+			name:   "no registry host",
+			image:  "app:1",
+			target: registry,
+			mode:   pathModeStripRegistry,
+			dst:    "registry.local/mirror/app:1",
+		},
+		{
+			name:   "local transport",
+			image:  "quay.io/org/app:1",
+			target: pushTarget{transport: transportContainersStorage},
+			mode:   pathModeStripRegistry,
+			dst:    "org/app:1",
+		},
+		{
+			name:   "registry without location",
+			image:  "quay.io/org/app:1",
+			target: pushTarget{transport: transportDocker},
+			mode:   pathModeBasename,
+			err:    "no mapping rule matches quay.io/org/app:1",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dst, err := destinationReference(tt.image, tt.target, tt.mode, nil)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.dst, dst)
+		})
+	}
+}
+
+func TestCheckCollisions(t *testing.T) {
+	assert.NoError(t, checkCollisions(map[string]string{
+		"quay.io/org/app:1": "registry.local/app:1",
+		"quay.io/org/app:2": "registry.local/app:2",
+	}))
+
+	err := checkCollisions(map[string]string{
+		"quay.io/org/app:1":   "registry.local/app:1",
+		"docker.io/org/app:1": "registry.local/app:1",
+		"ghcr.io/org/app:1":   "registry.local/app:1",
+		"quay.io/org/db:1":    "registry.local/db:1",
+		"quay.io/other/db:1":  "registry.local/db:1",
+		"quay.io/org/web:1":   "registry.local/web:1",
+	})
+	assert.EqualError(
+		t, err,
+		"multiple images map to the same destination: "+
+			"registry.local/app:1 (from docker.io/org/app:1, ghcr.io/org/app:1, quay.io/org/app:1); "+
+			"registry.local/db:1 (from quay.io/org/db:1, quay.io/other/db:1)",
+	)
+}
+
+func TestParseTarget(t *testing.T) {
+	for _, tt := range []struct {
+		destination string
+		target      pushTarget
+		err         string
+	}{
+		{
+			destination: "registry.local/mirror",
+			target:      pushTarget{transport: transportDocker, location: "registry.local/mirror"},
+		},
+		{
+			destination: "localhost:5000",
+			target:      pushTarget{transport: transportDocker, location: "localhost:5000"},
+		},
+		{
+			destination: "docker://registry.local/mirror",
+			target:      pushTarget{transport: transportDocker, location: "registry.local/mirror"},
+		},
+		{
+			destination: "containers-storage:",
+			target:      pushTarget{transport: transportContainersStorage},
+		},
+		{
+			destination: "containers-storage:[overlay@/var/lib/containers]",
+			target:      pushTarget{transport: transportContainersStorage, location: "[overlay@/var/lib/containers]"},
+		},
+		{
+			destination: "docker-daemon:",
+			target:      pushTarget{transport: transportDockerDaemon},
+		},
+		{
+			destination: "docker-daemon:app",
+			err:         "docker-daemon destination does not take a location",
+		},
+		{
+			destination: "oci:/srv/layout",
+			target:      pushTarget{transport: transportOCI, location: "/srv/layout"},
+		},
+		{
+			destination: "oci:",
+			err:         "oci destination requires a path",
+		},
+		{
+			destination: "dir:/srv/images",
+			target:      pushTarget{transport: transportDir, location: "/srv/images"},
+		},
+		{
+			destination: "dir:",
+			err:         "dir destination requires a path",
+		},
+		{
+			destination: "oci-archive:/srv/images.tar",
+			err:         "unsupported destination transport oci-archive",
+		},
+	} {
+		t.Run(tt.destination, func(t *testing.T) {
+			target, err := parseTarget(tt.destination)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.target, target)
+		})
+	}
+}
+
+func TestPushTargetReference(t *testing.T) {
+	pinned := "registry.local/app@sha256:" + strings.Repeat("a", 64)
+	for _, tt := range []struct {
+		name   string
+		target pushTarget
+		image  string
+		ref    string
+		err    string
+	}{
+		{
+			name:   "docker",
+			target: pushTarget{transport: transportDocker, location: "registry.local"},
+			image:  "registry.local/app:1",
+			ref:    "docker://registry.local/app:1",
+		},
+		{
+			name:   "docker pinned",
+			target: pushTarget{transport: transportDocker, location: "registry.local"},
+			image:  pinned,
+			ref:    "docker://" + pinned,
+		},
+		{
+			name:   "containers-storage",
+			target: pushTarget{transport: transportContainersStorage},
+			image:  "org/app:1",
+			ref:    "containers-storage:org/app:1",
+		},
+		{
+			name:   "containers-storage with store",
+			target: pushTarget{transport: transportContainersStorage, location: "[overlay@/srv]"},
+			image:  "org/app:1",
+			ref:    "containers-storage:[overlay@/srv]org/app:1",
+		},
+		{
+			name:   "docker-daemon",
+			target: pushTarget{transport: transportDockerDaemon},
+			image:  "app:1",
+			ref:    "docker-daemon:app:1",
+		},
+		{
+			name:   "docker-daemon pinned",
+			target: pushTarget{transport: transportDockerDaemon},
+			image:  pinned,
+			err:    "docker-daemon does not support digests, use --digest-tag",
+		},
+		{
+			name:   "oci",
+			target: pushTarget{transport: transportOCI, location: "/srv/layout"},
+			image:  "app:1",
+			ref:    "oci:/srv/layout:app:1",
+		},
+		{
+			name:   "dir",
+			target: pushTarget{transport: transportDir, location: "/srv/images"},
+			image:  "org/app:1",
+			ref:    "dir:/srv/images/org/app_1",
+		},
+		{
+			name:   "dir pinned",
+			target: pushTarget{transport: transportDir, location: "/srv/images"},
+			image:  pinned,
+			ref:    "dir:/srv/images/registry.local/app_sha256_" + strings.Repeat("a", 64),
+		},
+		{
+			name:   "unsupported",
+			target: pushTarget{transport: "sif"},
+			image:  "app:1",
+			err:    "unsupported destination transport sif",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := tt.target.reference(tt.image)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.ref, ref)
+		})
+	}
+}
+
+func TestPinDestination(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	raw := newTestImage(t, "linux", "amd64").manifest
+	stored := digest.FromBytes(raw)
+	image := "quay.io/org/app@" + stored.String()
+	store := storage.New(tmpdir)
+	assert.NoError(t, store.Image(image))
+	dst, err := store.NewImageDestination(ctx, nil)
+	assert.NoError(t, err)
+	assert.NoError(t, dst.PutManifest(ctx, raw, nil))
+	assert.NoError(t, dst.Commit(ctx, nil))
+
+	other := digest.FromString("other")
+	for _, tt := range []struct {
+		name string
+		dst  string
+		tag  string
+		ref  string
+		err  string
+	}{
+		{
+			name: "tagged",
+			dst:  "registry.local/org/app:1",
+			ref:  "registry.local/org/app:1",
+		},
+		{
+			name: "tagged without registry host",
+			dst:  "org/app:1",
+			ref:  "org/app:1",
+		},
+		{
+			name: "pinned",
+			dst:  "registry.local/org/app@" + stored.String(),
+			ref:  "registry.local/org/app@" + stored.String(),
+		},
+		{
+			name: "pinned to another digest",
+			dst:  "registry.local/org/app@" + other.String(),
+			ref:  "registry.local/org/app@" + stored.String(),
+		},
+		{
+			name: "pinned and tagged",
+			dst:  "registry.local/org/app:1@" + stored.String(),
+			ref:  "registry.local/org/app@" + stored.String(),
+		},
+		{
+			name: "pinned without registry host",
+			dst:  "app@" + stored.String(),
+			ref:  "docker.io/library/app@" + stored.String(),
+		},
+		{
+			name: "pinned with digest tag",
+			dst:  "registry.local/org/app@" + stored.String(),
+			tag:  "v1",
+			ref:  "registry.local/org/app:v1",
+		},
+		{
+			name: "invalid digest tag",
+			dst:  "registry.local/org/app@" + stored.String(),
+			tag:  "not a tag",
+			err:  "invalid tag not a tag",
+		},
+		{
+			name: "invalid destination",
+			dst:  "registry.local/org/app 1",
+			err:  "invalid destination registry.local/org/app 1 for " + image,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			ref, err := pinDestination(ctx, store, image, tt.dst, tt.tag)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.ref, ref)
+		})
+	}
+
+	_, err = pinDestination(ctx, store, "quay.io/org/missing:1", "registry.local/app@"+stored.String(), "")
+	assert.ErrorContains(t, err, "failed to read quay.io/org/missing:1 manifest")
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"path"
 
+	"github.com/docker/go-units"
 	"github.com/urfave/cli/v2"
 
 	"github.com/ricardomaraschini/tagbag/storage"
@@ -25,12 +26,22 @@ var diffCommand = &cli.Command{
 			Usage: "Temporary directory to use",
 			Value: "/tmp",
 		},
+		&cli.StringFlag{
+			Name:  "max-size",
+			Usage: "Maximum size of the extracted tarballs",
+			Value: "1TiB",
+		},
 		&cli.StringFlag{
 			Name:    "output",
 			Aliases: []string{"o"},
 			Usage:   "Destination tarball",
 			Value:   "./overlay.tgz",
 		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "Tarball compression (gzip, zstd or none)",
+			Value: "gzip",
+		},
 		&cli.StringFlag{
 			Name:     "v1",
 			Required: true,
@@ -43,6 +54,16 @@ var diffCommand = &cli.Command{
 		},
 	},
 	Action: func(c *cli.Context) error {
+		codec, err := tgz.CodecByName(c.String("compression"))
+		if err != nil {
+			return err
+		}
+
+		maxsize, err := units.RAMInBytes(c.String("max-size"))
+		if err != nil {
+			return fmt.Errorf("invalid max size: %w", err)
+		}
+
 		basedir := c.String("temp")
 		tempdir, err := os.MkdirTemp(basedir, "tagbag-*")
 		if err != nil {
@@ -54,14 +75,14 @@ var diffCommand = &cli.Command{
 		if err := os.MkdirAll(srcdir, 0700); err != nil {
 			return err
 		}
-		if err := tgz.Uncompress(c.String("v1"), srcdir); err != nil {
+		if err := tgz.Uncompress(c.String("v1"), srcdir, tgz.WithMaxSize(maxsize)); err != nil {
 			return fmt.Errorf("failed to uncompress tarball: %w", err)
 		}
 		tgtdir := path.Join(tempdir, "v2")
 		if err := os.MkdirAll(tgtdir, 0700); err != nil {
 			return err
 		}
-		if err := tgz.Uncompress(c.String("v2"), tgtdir); err != nil {
+		if err := tgz.Uncompress(c.String("v2"), tgtdir, tgz.WithMaxSize(maxsize)); err != nil {
 			return fmt.Errorf("failed to uncompress tarball: %w", err)
 		}
 		v1 := storage.New(srcdir)
@@ -78,7 +99,7 @@ var diffCommand = &cli.Command{
 			}
 		}
 		fmt.Println("Writing file", c.String("output"))
-		if err := tgz.Compress(tgtdir, c.String("output")); err != nil {
+		if err := tgz.Compress(tgtdir, c.String("output"), tgz.WithCodec(codec)); err != nil {
 			return fmt.Errorf("failed to compress tarball: %w", err)
 		}
 		return nil
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+	encconfig "github.com/containers/ocicrypt/config"
+	enchelpers "github.com/containers/ocicrypt/helpers"
+	"github.com/urfave/cli/v2"
+
+	"github.com/ricardomaraschini/tagbag/tgz"
+)
+
+// readPassphrase reads the passphrase stored in the provided file. Trailing
+// new lines are not part of the passphrase.
+func readPassphrase(fpath string) (string, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %w", err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", fpath)
+	}
+	return passphrase, nil
+}
+
+// encryptionOptions returns the tgz options encrypting the tarball to the
+// recipients read from the files given through --encrypt-to and to the
+// passphrase read from --passphrase-file. Returns no options if neither
+// has been given. age does not allow mixing passphrases with other
+// recipients.
+func encryptionOptions(c *cli.Context) ([]tgz.Option, error) {
+	var recipients []age.Recipient
+	for _, fpath := range c.StringSlice("encrypt-to") {
+		fp, err := os.Open(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open recipients file: %w", err)
+		}
+		parsed, err := age.ParseRecipients(fp)
+		fp.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse recipients in %s: %w", fpath, err)
+		}
+		recipients = append(recipients, parsed...)
+	}
+	if fpath := c.String("passphrase-file"); fpath != "" {
+		if len(recipients) > 0 {
+			return nil, fmt.Errorf("--encrypt-to and --passphrase-file are mutually exclusive")
+		}
+		passphrase, err := readPassphrase(fpath)
+		if err != nil {
+			return nil, err
+		}
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key from passphrase: %w", err)
+		}
+		recipients = append(recipients, recipient)
+	}
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+	return []tgz.Option{tgz.WithEncryption(recipients...)}, nil
+}
+
+// decryptionOptions returns the tgz options decrypting tarballs with the
+// identities read from the files given through --decrypt-key and with the
+// passphrase read from --passphrase-file. Returns no options if neither has
+// been given, unencrypted tarballs are read the same way either way.
+func decryptionOptions(c *cli.Context) ([]tgz.Option, error) {
+	var identities []age.Identity
+	for _, fpath := range c.StringSlice("decrypt-key") {
+		fp, err := os.Open(fpath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open identity file: %w", err)
+		}
+		parsed, err := age.ParseIdentities(fp)
+		fp.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse identities in %s: %w", fpath, err)
+		}
+		identities = append(identities, parsed...)
+	}
+	if fpath := c.String("passphrase-file"); fpath != "" {
+		passphrase, err := readPassphrase(fpath)
+		if err != nil {
+			return nil, err
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to derive key from passphrase: %w", err)
+		}
+		identities = append(identities, identity)
+	}
+	if len(identities) == 0 {
+		return nil, nil
+	}
+	return []tgz.Option{tgz.WithDecryption(identities...)}, nil
+}
+
+// layerEncryptConfig returns the ocicrypt configuration encrypting layers to
+// the provided keys, in the format used by podman and skopeo (jwe:key.pem,
+// pgp:user@host or pkcs7:cert.pem). Returns nil if no key is provided.
+func layerEncryptConfig(keys []string) (*encconfig.EncryptConfig, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	config, err := enchelpers.CreateCryptoConfig(keys, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return config.EncryptConfig, nil
+}
+
+// layerDecryptConfig returns the ocicrypt configuration decrypting layers
+// with the provided private keys (key.pem[:password]). Returns nil if no key
+// is provided.
+func layerDecryptConfig(keys []string) (*encconfig.DecryptConfig, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	config, err := enchelpers.CreateCryptoConfig([]string{}, keys)
+	if err != nil {
+		return nil, fmt.Errorf("invalid decryption key: %w", err)
+	}
+	return config.DecryptConfig, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+)
+
+//go:embed static/inspect-usage.txt
+var inspectUsageText string
+
+// inspectResult is the output of the inspect command.
+type inspectResult struct {
+	Images           []bundleImage `json:"images"`
+	Size             int64         `json:"size"`
+	DeduplicatedSize int64         `json:"deduplicatedSize"`
+}
+
+var inspectCommand = &cli.Command{
+	Name:      "inspect",
+	Usage:     "Lists the images stored in a tarball",
+	UsageText: inspectUsageText,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "source",
+			Required: true,
+			Aliases:  []string{"s"},
+			Usage:    "Source tarball path",
+		},
+		&cli.StringFlag{
+			Name:    "format",
+			Aliases: []string{"f"},
+			Usage:   "Output format (table or json)",
+			Value:   "table",
+		},
+		&cli.StringSliceFlag{
+			Name:  "decrypt-key",
+			Usage: "File with the age identities to decrypt encrypted tarballs with",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "File with the passphrase to decrypt encrypted tarballs with",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		format := c.String("format")
+		if format != "table" && format != "json" {
+			return fmt.Errorf("invalid format %q", format)
+		}
+
+		opts, err := decryptionOptions(c)
+		if err != nil {
+			return err
+		}
+		scanner := newBundleScanner()
+		scanner.opts = opts
+		if err := scanner.scan(c.String("source")); err != nil {
+			return fmt.Errorf("failed to read tarball: %w", err)
+		}
+		images, err := scanner.images()
+		if err != nil {
+			return fmt.Errorf("failed to inspect images: %w", err)
+		}
+		result := inspectResult{
+			Images:           images,
+			DeduplicatedSize: scanner.size(),
+		}
+		for _, image := range images {
+			result.Size += image.Size
+		}
+
+		if format == "json" {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			return encoder.Encode(result)
+		}
+
+		writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+		fmt.Fprintln(writer, "IMAGE\tDIGEST\tPLATFORMS\tLAYERS\tSIZE")
+		for _, image := range images {
+			fmt.Fprintf(
+				writer,
+				"%s\t%s\t%s\t%d\t%s\n",
+				image.Name,
+				image.Digest,
+				strings.Join(image.Platforms, ","),
+				image.Layers,
+				units.HumanSize(float64(image.Size)),
+			)
+		}
+		if err := writer.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+		fmt.Println("Images:", len(images))
+		fmt.Println("Total size:", units.HumanSize(float64(result.Size)))
+		fmt.Println("Deduplicated size:", units.HumanSize(float64(result.DeduplicatedSize)))
+		return nil
+	},
+}
@@ -15,6 +15,10 @@ func main() {
 			pullCommand,
 			pushCommand,
 			diffCommand,
+			inspectCommand,
+			verifyCommand,
+			signCommand,
+			verifySignatureCommand,
 			versionCommand,
 		},
 	}
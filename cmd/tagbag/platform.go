@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/platform"
+)
+
+// parsePlatforms parses platforms in the os/arch[/variant] format.
+func parsePlatforms(values []string) ([]platform.Platform, error) {
+	var platforms []platform.Platform
+	for _, value := range values {
+		parsed, err := platform.Parse(value)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, parsed)
+	}
+	return platforms, nil
+}
+
+// selectInstances returns the digests of the instances of the manifest list
+// referred by ref that match any of the provided platforms. Returns nil if
+// ref does not refer to a manifest list and an error if no instance
+// matches.
+func selectInstances(
+	ctx context.Context, ref types.ImageReference, sys *types.SystemContext, platforms []platform.Platform,
+) ([]digest.Digest, error) {
+	src, err := ref.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open source: %w", err)
+	}
+	defer src.Close()
+	raw, mime, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if !manifest.MIMETypeIsMultiImage(mime) {
+		return nil, nil
+	}
+	return platform.MatchInstances(raw, platforms)
+}
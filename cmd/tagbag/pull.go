@@ -1,20 +1,34 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sync"
 
+	"github.com/docker/go-units"
 	"github.com/urfave/cli/v2"
 	"go.podman.io/image/v5/copy"
-	"go.podman.io/image/v5/signature"
-	"go.podman.io/image/v5/transports/alltransports"
 	"go.podman.io/image/v5/types"
 
+	"github.com/ricardomaraschini/tagbag/platform"
+	"github.com/ricardomaraschini/tagbag/policy"
 	"github.com/ricardomaraschini/tagbag/storage"
 	"github.com/ricardomaraschini/tagbag/tgz"
 )
 
+// Bundle formats.
+const (
+	// formatTagbag stores each image in its own directory, using the
+	// directory transport, with blobs shared by all images.
+	formatTagbag = "tagbag"
+	// formatOCI stores images as a standard OCI image layout.
+	formatOCI = "oci"
+)
+
 //go:embed static/pull-usage.txt
 var pullUsageText string
 
@@ -24,26 +38,64 @@ var pullCommand = &cli.Command{
 	UsageText: pullUsageText,
 	Flags: []cli.Flag{
 		&cli.StringSliceFlag{
-			Name:     "image",
-			Aliases:  []string{"i"},
-			Usage:    "Images to pull to the tarball",
-			Required: true,
+			Name:    "image",
+			Aliases: []string{"i"},
+			Usage:   "Images to pull to the tarball",
+		},
+		&cli.StringSliceFlag{
+			Name:  "from-archive",
+			Usage: "Pull all images from docker-archive or oci-archive tarballs (PATH[=REPOSITORY])",
 		},
 		&cli.StringFlag{
 			Name:  "temp",
 			Usage: "Temporary directory to use",
 			Value: "/tmp",
 		},
+		&cli.StringFlag{
+			Name:  "workdir",
+			Usage: "Directory to pull the images into, kept after the pull (a temporary directory by default)",
+		},
+		&cli.BoolFlag{
+			Name:  "resume",
+			Usage: "Resume an interrupted pull into --workdir",
+			Value: false,
+		},
 		&cli.StringFlag{
 			Name:    "output",
 			Aliases: []string{"o"},
 			Usage:   "Destination tarball",
 			Value:   "./tagbag.tgz",
 		},
+		&cli.StringFlag{
+			Name:  "compression",
+			Usage: "Tarball compression (gzip, zstd or none)",
+			Value: "gzip",
+		},
+		&cli.StringFlag{
+			Name:  "split-size",
+			Usage: "Split the tarball into volumes of at most this size (e.g. 4G)",
+		},
+		&cli.StringSliceFlag{
+			Name:  "encrypt-to",
+			Usage: "File with the age recipients (public keys) to encrypt the tarball to",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "File with the passphrase to encrypt the tarball with",
+		},
+		&cli.StringFlag{
+			Name:  "format",
+			Usage: "Bundle format (tagbag or oci)",
+			Value: formatTagbag,
+		},
 		&cli.StringFlag{
 			Name:  "authfile",
 			Usage: "Path of the authentication file",
 		},
+		&cli.StringFlag{
+			Name:  "signature-policy",
+			Usage: "Path of the signature verification policy (containers-policy.json format)",
+		},
 		&cli.BoolFlag{
 			Name:  "insecure",
 			Usage: "Ignore TLS certificate errors",
@@ -54,67 +106,345 @@ var pullCommand = &cli.Command{
 			Usage: "Pull all images (manifest lists)",
 			Value: false,
 		},
+		&cli.StringSliceFlag{
+			Name:  "platform",
+			Usage: "Pull only the given platforms (os/arch[/variant]) of manifest lists",
+		},
+		&cli.BoolFlag{
+			Name:  "with-signatures",
+			Usage: "Pull signatures, attestations and other artifacts attached to the images",
+			Value: false,
+		},
+		&cli.StringSliceFlag{
+			Name:  "decryption-key",
+			Usage: "Private key (key.pem[:password]) to decrypt encrypted layers with",
+		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Usage: "Number of images to pull concurrently",
+			Value: 1,
+		},
 	},
 	Action: func(c *cli.Context) error {
-		basedir := c.String("temp")
-		tempdir, err := os.MkdirTemp(basedir, "tagbag-*")
+		codec, err := tgz.CodecByName(c.String("compression"))
 		if err != nil {
-			return fmt.Errorf("failed to create %s directory: %w", tempdir, err)
+			return err
 		}
-		defer os.RemoveAll(tempdir)
-
-		pol := &signature.Policy{
-			Default: signature.PolicyRequirements{
-				signature.NewPRInsecureAcceptAnything(),
-			},
-		}
-		polctx, err := signature.NewPolicyContext(pol)
+		encrypt, err := encryptionOptions(c)
 		if err != nil {
-			return fmt.Errorf("failed to create policy: %w", err)
+			return err
+		}
+		tgzopts := append([]tgz.Option{tgz.WithCodec(codec)}, encrypt...)
+		if split := c.String("split-size"); split != "" {
+			size, err := units.RAMInBytes(split)
+			if err != nil || size <= 0 {
+				return fmt.Errorf("invalid split size %q", split)
+			}
+			tgzopts = append(tgzopts, tgz.WithSplitSize(size))
+		}
+		format := c.String("format")
+		if format != formatTagbag && format != formatOCI {
+			return fmt.Errorf("unknown format %q", format)
 		}
+
+		resume := c.Bool("resume")
+		tempdir := c.String("workdir")
+		if tempdir != "" {
+			if err := prepareWorkdir(tempdir, resume); err != nil {
+				return err
+			}
+		} else if resume {
+			return fmt.Errorf("--resume requires --workdir")
+		} else {
+			basedir := c.String("temp")
+			if tempdir, err = os.MkdirTemp(basedir, "tagbag-*"); err != nil {
+				return fmt.Errorf("failed to create %s directory: %w", tempdir, err)
+			}
+			defer os.RemoveAll(tempdir)
+		}
+
 		imglist := copy.CopySystemImage
 		if c.Bool("all") {
 			imglist = copy.CopyAllImages
 		}
+		platforms, err := parsePlatforms(c.StringSlice("platform"))
+		if err != nil {
+			return err
+		}
+		if len(platforms) > 0 && c.Bool("all") {
+			return fmt.Errorf("--all and --platform are mutually exclusive")
+		}
+
+		polfile := c.String("signature-policy")
+		if polfile != "" {
+			polctx, err := policy.FromFile(polfile)
+			if err != nil {
+				return err
+			}
+			polctx.Destroy()
+		}
 
 		insecure := types.OptionalBoolFalse
 		if c.Bool("insecure") {
 			insecure = types.OptionalBoolTrue
 		}
 
-		storage := storage.New(tempdir)
-		for _, src := range c.StringSlice("image") {
-			if err := storage.Image(src); err != nil {
-				return fmt.Errorf("failed start %s write: %w", src, err)
+		parallel := c.Int("parallel")
+		if parallel < 1 {
+			return fmt.Errorf("invalid parallel value %d", parallel)
+		}
+		// progress bars of concurrent copies would be interleaved so we
+		// only report them when pulling one image at a time.
+		var report io.Writer = os.Stdout
+		if parallel > 1 {
+			report = io.Discard
+		}
+
+		values := c.StringSlice("image")
+		for _, archive := range c.StringSlice("from-archive") {
+			images, err := archiveSources(archive)
+			if err != nil {
+				return err
 			}
-			withproto := fmt.Sprintf("docker://%s", src)
-			srcref, err := alltransports.ParseImageName(withproto)
+			values = append(values, images...)
+		}
+		if len(values) == 0 {
+			return fmt.Errorf("either --image or --from-archive must be provided")
+		}
+		images, err := parseSources(values)
+		if err != nil {
+			return err
+		}
+
+		index := &storage.Index{
+			TagbagVersion: Version,
+			Platforms:     platforms,
+			Images:        make([]storage.IndexImage, len(images)),
+		}
+		attachments := make([][]storage.IndexImage, len(images))
+		storage := storage.New(tempdir)
+		if resume {
+			restored, removed, err := storage.RestoreSeen()
 			if err != nil {
-				return fmt.Errorf("failed parse %s transport: %w", src, err)
+				return fmt.Errorf("failed to restore blobs: %w", err)
+			}
+			fmt.Println("Restored", restored, "blobs from", tempdir)
+			if removed > 0 {
+				fmt.Println("Removed", removed, "corrupt blobs, they will be pulled again")
 			}
-			fmt.Println("Pulling", src)
-			if _, err := copy.Image(
-				c.Context,
-				polctx,
-				storage,
-				srcref,
-				&copy.Options{
+		}
+		withsigs := c.Bool("with-signatures")
+		decrypt, err := layerDecryptConfig(c.StringSlice("decryption-key"))
+		if err != nil {
+			return err
+		}
+		if decrypt != nil && withsigs {
+			return fmt.Errorf("--with-signatures and --decryption-key are mutually exclusive")
+		}
+		var mtx sync.Mutex
+		claimed := map[string]bool{}
+		for _, src := range images {
+			claimed[src.name] = true
+		}
+		// images sharing a digest share their attachments, these are
+		// pulled only once.
+		claim := func(name string) bool {
+			mtx.Lock()
+			defer mtx.Unlock()
+			if claimed[name] {
+				return false
+			}
+			claimed[name] = true
+			return true
+		}
+
+		ctx, cancel := context.WithCancel(c.Context)
+		defer cancel()
+		errs := make([]error, len(images))
+		sem := make(chan struct{}, parallel)
+		var wg sync.WaitGroup
+		for i, src := range images {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				if ctx.Err() != nil {
+					return
+				}
+				fmt.Println("Pulling", src.name)
+				opts := &copy.Options{
 					SourceCtx: &types.SystemContext{
 						AuthFilePath:                c.String("authfile"),
 						DockerInsecureSkipTLSVerify: insecure,
 					},
 					DestinationCtx:     &types.SystemContext{},
-					ReportWriter:       os.Stdout,
+					ReportWriter:       report,
 					ImageListSelection: imglist,
-				},
-			); err != nil {
-				return fmt.Errorf("failed copy %s: %w", src, err)
+					RemoveSignatures:   !withsigs,
+					OciDecryptConfig:   decrypt,
+				}
+				image, err := pullImage(ctx, storage, src, platforms, polfile, opts)
+				if err != nil {
+					errs[i] = err
+					cancel()
+					return
+				}
+				if withsigs {
+					if attachments[i], err = pullAttachments(
+						ctx, storage, src, image, opts, claim,
+					); err != nil {
+						errs[i] = err
+						cancel()
+						return
+					}
+				}
+				if parallel > 1 {
+					fmt.Println("Pulled", src.name)
+				}
+				index.Images[i] = image
+			}()
+		}
+		wg.Wait()
+		if err := errors.Join(errs...); err != nil {
+			return err
+		}
+		for _, images := range attachments {
+			index.Images = append(index.Images, images...)
+		}
+		if resume {
+			// the interrupted pull may have pulled other images, or
+			// written an oci layout, none of it goes in the tarball.
+			pulled := make([]string, len(index.Images))
+			for i, image := range index.Images {
+				pulled[i] = image.Reference
+			}
+			removed, err := storage.Prune(pulled)
+			if err != nil {
+				return fmt.Errorf("failed to prune %s: %w", tempdir, err)
+			}
+			if removed > 0 {
+				fmt.Println("Removed", removed, "images not requested from", tempdir)
 			}
 		}
+		if format == formatOCI {
+			// image directories are kept, and left out of the
+			// tarball, so the pull can be resumed until the tarball
+			// has been written.
+			if err := storage.WriteOCILayout(); err != nil {
+				return fmt.Errorf("failed to write oci layout: %w", err)
+			}
+			tgzopts = append(tgzopts, tgz.WithFilter(withoutImageDirs))
+			for i := range index.Images {
+				if len(index.Images[i].Signatures) > 0 {
+					fmt.Println("Dropping signatures of", index.Images[i].Reference, "not supported by the oci format")
+				}
+				index.Images[i].Path = ""
+				index.Images[i].Signatures = nil
+			}
+		}
+		if err := storage.WriteIndex(index); err != nil {
+			return fmt.Errorf("failed to write index: %w", err)
+		}
 		fmt.Println("Writing file", c.String("output"))
-		if err = tgz.Compress(tempdir, c.String("output")); err != nil {
+		if err = tgz.Compress(tempdir, c.String("output"), tgzopts...); err != nil {
 			return fmt.Errorf("failed compress: %w", err)
 		}
 		return nil
 	},
 }
+
+// pullImage copies src into its own image inside the provided storage and
+// returns the image description. Images are verified against the policy
+// stored in polfile, any image is accepted if it is empty. Each call uses
+// its own storage reference and policy context so it can run concurrently
+// with other pulls into the same storage. Images already completely pulled
+// into the storage, by an interrupted pull being resumed, are not pulled
+// again.
+func pullImage(
+	ctx context.Context,
+	store *storage.Storage,
+	src pullSource,
+	platforms []platform.Platform,
+	polfile string,
+	opts *copy.Options,
+) (storage.IndexImage, error) {
+	complete, err := store.Complete(src.name)
+	if err != nil {
+		return storage.IndexImage{}, err
+	}
+	if complete {
+		fmt.Println("Skipping", src.name, "already pulled")
+		return describeImage(ctx, store, src.name)
+	}
+	ref, err := store.Reference(src.name)
+	if err != nil {
+		return storage.IndexImage{}, fmt.Errorf("failed start %s write: %w", src.name, err)
+	}
+	if src.pinned {
+		// the whole manifest list is copied otherwise the manifest
+		// stored would not match the pinned digest.
+		if len(platforms) > 0 {
+			fmt.Println("Ignoring platforms for digest pinned image", src.name)
+		}
+		pinned := *opts
+		pinned.ImageListSelection = copy.CopyAllImages
+		opts = &pinned
+	} else if len(platforms) > 0 {
+		instances, err := selectInstances(ctx, src.ref, opts.SourceCtx, platforms)
+		if err != nil {
+			return storage.IndexImage{}, fmt.Errorf("failed to select %s platforms: %w", src.name, err)
+		}
+		if instances != nil {
+			// the manifest list is trimmed to the selected instances
+			// so it can be pushed as is.
+			selected := *opts
+			selected.ImageListSelection = copy.CopySpecificImages
+			selected.Instances = instances
+			selected.SparseManifestListAction = copy.StripSparseManifestList
+			opts = &selected
+		}
+	}
+	polctx, err := policy.ContextFor(polfile)
+	if err != nil {
+		return storage.IndexImage{}, fmt.Errorf("failed to create policy: %w", err)
+	}
+	defer polctx.Destroy()
+	if _, err := copy.Image(ctx, polctx, ref, src.ref, opts); err != nil {
+		return storage.IndexImage{}, fmt.Errorf("failed copy %s: %w", src.name, err)
+	}
+	return describeImage(ctx, store, src.name)
+}
+
+// withoutImageDirs is a tgz filter leaving the image directories out of
+// tarballs in the oci format, where images are stored in the layout.
+func withoutImageDirs(name string) bool {
+	return name != storage.ImagesDir
+}
+
+// describeImage returns the description of the provided image, as stored
+// in the index.
+func describeImage(ctx context.Context, store *storage.Storage, name string) (storage.IndexImage, error) {
+	image, err := store.Describe(ctx, name)
+	if err != nil {
+		return storage.IndexImage{}, fmt.Errorf("failed to describe %s: %w", name, err)
+	}
+	return image, nil
+}
+
+// prepareWorkdir creates the provided work directory if needed. Unless an
+// interrupted pull is being resumed the directory must be empty, leftovers
+// of previous pulls would otherwise end up in the tarball.
+func prepareWorkdir(dir string, resume bool) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create %s directory: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read %s directory: %w", dir, err)
+	}
+	if len(entries) > 0 && !resume {
+		return fmt.Errorf("%s is not empty, use --resume to resume an interrupted pull", dir)
+	}
+	return nil
+}
@@ -1,17 +1,27 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"path"
+	"strings"
+	"sync"
+	"text/tabwriter"
 
+	"github.com/docker/go-units"
 	"github.com/urfave/cli/v2"
 	"go.podman.io/image/v5/copy"
-	"go.podman.io/image/v5/signature"
+	"go.podman.io/image/v5/docker"
+	"go.podman.io/image/v5/docker/reference"
 	"go.podman.io/image/v5/transports/alltransports"
 	"go.podman.io/image/v5/types"
 
+	"github.com/ricardomaraschini/tagbag/mapping"
+	"github.com/ricardomaraschini/tagbag/policy"
+	"github.com/ricardomaraschini/tagbag/signing"
 	"github.com/ricardomaraschini/tagbag/storage"
 	"github.com/ricardomaraschini/tagbag/tgz"
 )
@@ -29,6 +39,11 @@ var pushCommand = &cli.Command{
 			Usage: "Temporary directory to use",
 			Value: "/tmp",
 		},
+		&cli.StringFlag{
+			Name:  "max-size",
+			Usage: "Maximum size of the extracted tarballs",
+			Value: "1TiB",
+		},
 		&cli.StringFlag{
 			Name:     "source",
 			Required: true,
@@ -36,15 +51,44 @@ var pushCommand = &cli.Command{
 			Usage:    "Source tarball path",
 		},
 		&cli.StringFlag{
-			Name:     "destination",
-			Required: true,
-			Aliases:  []string{"d"},
-			Usage:    "Destination registry address",
+			Name:    "destination",
+			Aliases: []string{"d"},
+			Usage:   "Destination registry address or transport (containers-storage:, docker-daemon:, oci:PATH, dir:PATH)",
+		},
+		&cli.StringFlag{
+			Name:    "mapping",
+			Aliases: []string{"m"},
+			Usage:   "File with rules mapping image names to destinations",
+		},
+		&cli.StringFlag{
+			Name:  "digest-tag",
+			Usage: "Tag to push digest pinned images with instead of pushing them by digest",
+		},
+		&cli.BoolFlag{
+			Name:  "dry-run",
+			Usage: "Print where each image would be pushed to and exit",
+			Value: false,
 		},
 		&cli.StringFlag{
 			Name:  "authfile",
 			Usage: "Path of the authentication file",
 		},
+		&cli.StringFlag{
+			Name:  "signature-policy",
+			Usage: "Path of the signature verification policy (containers-policy.json format)",
+		},
+		&cli.StringFlag{
+			Name:  "verify-key",
+			Usage: "Public key the tarballs must be signed with, unsigned or mis-signed tarballs are refused",
+		},
+		&cli.StringSliceFlag{
+			Name:  "decrypt-key",
+			Usage: "File with the age identities to decrypt encrypted tarballs with",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "File with the passphrase to decrypt encrypted tarballs with",
+		},
 		&cli.StringSliceFlag{
 			Name:    "overlay",
 			Aliases: []string{"o"},
@@ -55,17 +99,35 @@ var pushCommand = &cli.Command{
 			Usage: "Ignore TLS certificate errors",
 			Value: false,
 		},
+		&cli.IntFlag{
+			Name:  "parallel",
+			Usage: "Number of images to push concurrently",
+			Value: 1,
+		},
+		&cli.StringFlag{
+			Name:  "path-mode",
+			Usage: "How image names map to destination paths (basename, strip-registry or full)",
+			Value: pathModeBasename,
+		},
+		&cli.BoolFlag{
+			Name:  "remove-signatures",
+			Usage: "Do not push signatures, attestations and other artifacts attached to the images",
+			Value: false,
+		},
+		&cli.StringSliceFlag{
+			Name:  "encryption-key",
+			Usage: "Encrypt the layers to the key (jwe:key.pem, pgp:user@host or pkcs7:cert.pem)",
+		},
+		&cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "Keep pushing the remaining images when one fails",
+			Value: false,
+		},
 	},
 	Action: func(c *cli.Context) error {
-		pol := &signature.Policy{
-			Default: signature.PolicyRequirements{
-				signature.NewPRInsecureAcceptAnything(),
-			},
-		}
-
-		polctx, err := signature.NewPolicyContext(pol)
+		maxsize, err := units.RAMInBytes(c.String("max-size"))
 		if err != nil {
-			return fmt.Errorf("failed to create policy: %w", err)
+			return fmt.Errorf("invalid max size: %w", err)
 		}
 
 		basedir := c.String("temp")
@@ -75,54 +137,395 @@ var pushCommand = &cli.Command{
 		}
 		defer os.RemoveAll(tempdir)
 
-		if err := tgz.Uncompress(c.String("source"), tempdir); err != nil {
-			return fmt.Errorf("failed to uncompress tarball: %w", err)
+		decrypt, err := decryptionOptions(c)
+		if err != nil {
+			return err
 		}
-		for _, overlay := range c.StringSlice("overlay") {
-			if err := tgz.Uncompress(overlay, tempdir); err != nil {
-				return fmt.Errorf("failed to uncompress overlay: %w", err)
+		sources := append([]string{c.String("source")}, c.StringSlice("overlay")...)
+		var signed *signedBundle
+		if c.String("verify-key") != "" {
+			key, err := signing.LoadPublicKey(c.String("verify-key"))
+			if err != nil {
+				return err
+			}
+			if signed, err = verifyBundleSignatures(key, decrypt, sources); err != nil {
+				return err
 			}
 		}
+		opts := append([]tgz.Option{tgz.WithMaxSize(maxsize)}, decrypt...)
+		blobs, err := extractBundle(tempdir, opts, sources...)
+		if err != nil {
+			return fmt.Errorf("failed to extract tarballs: %w", err)
+		}
+		defer blobs.Close()
 		storage := storage.New(tempdir)
+		storage.AddBlobSource(blobs)
+		if err := storage.ImportOCILayout(); err != nil {
+			return fmt.Errorf("failed to read oci layout: %w", err)
+		}
+		if signed != nil {
+			if err := signed.check(c.Context, storage); err != nil {
+				return fmt.Errorf("failed to check tarballs against the signed index: %w", err)
+			}
+		}
 		images, err := storage.Images()
 		if err != nil {
 			return fmt.Errorf("failed to list images: %w", err)
 		}
 
+		polfile := c.String("signature-policy")
+		if polfile != "" {
+			polctx, err := policy.FromFile(polfile)
+			if err != nil {
+				return err
+			}
+			polctx.Destroy()
+		}
+
 		insecure := types.OptionalBoolFalse
 		if c.Bool("insecure") {
 			insecure = types.OptionalBoolTrue
 		}
 
+		parallel := c.Int("parallel")
+		if parallel < 1 {
+			return fmt.Errorf("invalid parallel value %d", parallel)
+		}
+		// progress bars of concurrent copies would be interleaved so we
+		// only report them when pushing one image at a time.
+		var report io.Writer = os.Stdout
+		if parallel > 1 {
+			report = io.Discard
+		}
+
+		var rules *mapping.Mapping
+		if c.String("mapping") != "" {
+			if rules, err = mapping.Load(c.String("mapping")); err != nil {
+				return err
+			}
+		} else if c.String("destination") == "" {
+			return fmt.Errorf("either --destination or --mapping must be provided")
+		}
+
+		target, err := parseTarget(c.String("destination"))
+		if err != nil {
+			return err
+		}
+		subjects, err := attachmentSubjects(storage)
+		if err != nil {
+			return err
+		}
+		encrypt, err := layerEncryptConfig(c.StringSlice("encryption-key"))
+		if err != nil {
+			return err
+		}
+		// an empty list of layers means all layers.
+		var encryptLayers *[]int
+		nosigs := c.Bool("remove-signatures")
+		if encrypt != nil {
+			encryptLayers = &[]int{}
+			if len(subjects) > 0 && !nosigs {
+				fmt.Println("Skipping attachments, encrypted images no longer match them")
+			}
+			nosigs = true
+		}
+		if len(subjects) > 0 && !nosigs && !target.keepsAttachments() {
+			fmt.Println("Skipping attachments, not supported by", target.transport, "destinations")
+			nosigs = true
+		}
+		names := map[string]string{}
 		for _, src := range images {
-			if err := storage.Image(src); err != nil {
-				return fmt.Errorf("failed to load image: %w", err)
+			if _, ok := subjects[src]; ok {
+				continue
 			}
-			_, repo := path.Split(src)
-			withproto := fmt.Sprintf("docker://%s/%s", c.String("d"), repo)
-			dstref, err := alltransports.ParseImageName(withproto)
+			dst, err := destinationReference(src, target, c.String("path-mode"), rules)
 			if err != nil {
-				return fmt.Errorf("failed parse %s transport: %w", src, err)
-			}
-			fmt.Println("Pushing", src, "to", withproto)
-			if _, err := copy.Image(
-				c.Context,
-				polctx,
-				dstref,
-				storage,
-				&copy.Options{
+				return err
+			}
+			if names[src], err = pinDestination(c.Context, storage, src, dst, c.String("digest-tag")); err != nil {
+				return err
+			}
+			if encrypt != nil && strings.Contains(names[src], "@") {
+				return fmt.Errorf("%s can't be encrypted and pushed by digest, use --digest-tag", src)
+			}
+		}
+		// attachments follow the images they are attached to.
+		for src, subject := range subjects {
+			if nosigs {
+				break
+			}
+			dst, ok := names[subject]
+			if !ok {
+				return fmt.Errorf("image %s not found, %s is attached to it", subject, src)
+			}
+			if names[src], err = attachmentDestination(src, dst); err != nil {
+				return err
+			}
+		}
+		// attachments are not signed themselves, the ones proven to be
+		// attached to their subject follow the verified subject while
+		// the others are checked against the policy as any image.
+		exempt := map[string]bool{}
+		if polfile != "" && !nosigs {
+			if exempt, err = verifiedAttachments(c.Context, storage, subjects); err != nil {
+				return err
+			}
+		}
+		var selected []string
+		destinations := map[string]string{}
+		for _, src := range images {
+			if _, ok := names[src]; !ok {
+				continue
+			}
+			selected = append(selected, src)
+			if destinations[src], err = target.reference(names[src]); err != nil {
+				return fmt.Errorf("invalid destination for %s: %w", src, err)
+			}
+		}
+		images = selected
+		if err := checkCollisions(destinations); err != nil {
+			return err
+		}
+		if c.Bool("dry-run") {
+			return printDestinations(images, destinations)
+		}
+
+		keepgoing := c.Bool("keep-going")
+		ctx, cancel := context.WithCancel(c.Context)
+		defer cancel()
+		results := make([]pushResult, len(images))
+		sem := make(chan struct{}, parallel)
+		var wg sync.WaitGroup
+		for i, src := range images {
+			results[i] = pushResult{
+				image:       src,
+				destination: destinations[src],
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				if ctx.Err() != nil {
+					return
+				}
+				fmt.Println("Pushing", src, "to", results[i].destination)
+				imgpolfile := polfile
+				if exempt[src] {
+					imgpolfile = ""
+				}
+				if err := pushImage(ctx, storage, src, results[i].destination, imgpolfile, &copy.Options{
 					DestinationCtx: &types.SystemContext{
 						AuthFilePath:                c.String("authfile"),
 						DockerInsecureSkipTLSVerify: insecure,
 					},
 					SourceCtx:          &types.SystemContext{},
-					ReportWriter:       os.Stdout,
-					ImageListSelection: copy.CopyAllImages,
-				},
-			); err != nil {
-				return fmt.Errorf("failed copy %s: %w", src, err)
-			}
+					ReportWriter:       report,
+					ImageListSelection: target.imageListSelection(),
+					RemoveSignatures:   nosigs || !target.keepsSignatures(),
+					OciEncryptConfig:   encrypt,
+					OciEncryptLayers:   encryptLayers,
+				}); err != nil {
+					results[i].err = err
+					if !results[i].failed() {
+						fmt.Println("Skipped", src)
+						return
+					}
+					fmt.Println("Failed to push", src)
+					if !keepgoing {
+						cancel()
+					}
+					return
+				}
+				results[i].pushed = true
+				if parallel > 1 {
+					fmt.Println("Pushed", src)
+				}
+			}()
 		}
-		return nil
+		wg.Wait()
+		return printPushReport(results)
 	},
 }
+
+// pushResult holds the outcome of pushing a single image. An image that
+// has neither been pushed nor failed has been skipped, this happens when
+// the push is aborted before the image is attempted or while it is in
+// flight (its error is then context.Canceled).
+type pushResult struct {
+	image       string
+	destination string
+	pushed      bool
+	err         error
+}
+
+// failed returns true if pushing the image failed on its own, as opposed
+// to being canceled because the push has been aborted.
+func (p pushResult) failed() bool {
+	return p.err != nil && !errors.Is(p.err, context.Canceled)
+}
+
+// status returns a human readable status for the result.
+func (p pushResult) status() string {
+	if p.pushed {
+		return "pushed"
+	} else if p.failed() {
+		return "failed"
+	}
+	return "skipped"
+}
+
+// printPushReport prints the outcome of pushing each image. Returns an
+// error if any image has not been pushed, only images that failed on their
+// own are counted as failures, canceled ones are counted as skipped.
+func printPushReport(results []pushResult) error {
+	var pushed, failed, skipped int
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 3, ' ', 0)
+	fmt.Fprintln(writer, "IMAGE\tDESTINATION\tSTATUS\tREASON")
+	for _, result := range results {
+		var reason string
+		switch {
+		case result.pushed:
+			pushed++
+		case result.failed():
+			failed++
+			reason = result.err.Error()
+		default:
+			skipped++
+		}
+		fmt.Fprintf(
+			writer,
+			"%s\t%s\t%s\t%s\n",
+			result.image,
+			result.destination,
+			result.status(),
+			reason,
+		)
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+	fmt.Printf("%d pushed, %d skipped, %d failed\n", pushed, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("failed to push %d image(s), %d skipped", failed, skipped)
+	} else if skipped > 0 {
+		return fmt.Errorf("push aborted, %d image(s) skipped", skipped)
+	}
+	return nil
+}
+
+// pushImage copies src, stored in the provided storage, to dst. Images are
+// verified against the policy stored in polfile, any image is accepted if
+// it is empty. Policy scopes and signed identities are matched against the
+// docker reference the image was pulled from, see bundleReference. Each call
+// uses its own storage reference and policy context so it can run
+// concurrently with other pushes from the same storage.
+func pushImage(
+	ctx context.Context, store *storage.Storage, src, dst, polfile string, opts *copy.Options,
+) error {
+	stored, err := store.Reference(src)
+	if err != nil {
+		return fmt.Errorf("failed to load image: %w", err)
+	}
+	var ref types.ImageReference = stored
+	if polfile != "" {
+		if ref, err = newBundleReference(stored, src); err != nil {
+			return err
+		}
+	}
+	dstref, err := alltransports.ParseImageName(dst)
+	if err != nil {
+		return fmt.Errorf("failed parse %s transport: %w", src, err)
+	}
+	polctx, err := policy.ContextFor(polfile)
+	if err != nil {
+		return fmt.Errorf("failed to create policy: %w", err)
+	}
+	defer polctx.Destroy()
+	if _, err := copy.Image(ctx, polctx, dstref, ref, opts); err != nil {
+		return fmt.Errorf("failed copy %s: %w", src, err)
+	}
+	return nil
+}
+
+// bundleReference is an image stored in a bundle that identifies itself, to
+// signature policies, as the docker reference it was pulled from. Policy
+// scopes and the identities signatures are made for are docker references,
+// the location of the image inside the bundle matches none of them.
+type bundleReference struct {
+	*storage.Storage
+	identity types.ImageReference
+}
+
+// newBundleReference returns a reference to image, stored in ref, identified
+// by the image name as recorded in the bundle index. Docker references can't
+// carry both a tag and a digest, images pinned by digest are identified by
+// the digest alone.
+func newBundleReference(ref *storage.Storage, image string) (*bundleReference, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name %s: %w", image, err)
+	}
+	if canonical, ok := named.(reference.Canonical); ok {
+		if named, err = reference.WithDigest(
+			reference.TrimNamed(canonical), canonical.Digest(),
+		); err != nil {
+			return nil, fmt.Errorf("invalid image name %s: %w", image, err)
+		}
+	}
+	identity, err := docker.NewReference(named)
+	if err != nil {
+		return nil, fmt.Errorf("invalid image name %s: %w", image, err)
+	}
+	return &bundleReference{Storage: ref, identity: identity}, nil
+}
+
+// Transport returns the docker transport.
+func (b *bundleReference) Transport() types.ImageTransport {
+	return b.identity.Transport()
+}
+
+// StringWithinTransport returns the docker reference of the image.
+func (b *bundleReference) StringWithinTransport() string {
+	return b.identity.StringWithinTransport()
+}
+
+// DockerReference returns the docker reference of the image.
+func (b *bundleReference) DockerReference() reference.Named {
+	return b.identity.DockerReference()
+}
+
+// PolicyConfigurationIdentity returns the identity of the docker reference.
+func (b *bundleReference) PolicyConfigurationIdentity() string {
+	return b.identity.PolicyConfigurationIdentity()
+}
+
+// PolicyConfigurationNamespaces returns the namespaces of the docker
+// reference.
+func (b *bundleReference) PolicyConfigurationNamespaces() []string {
+	return b.identity.PolicyConfigurationNamespaces()
+}
+
+// NewImageSource returns a handler used to read the image from the bundle.
+// The handler reports the bundleReference as its reference, this is what
+// policies are checked against.
+func (b *bundleReference) NewImageSource(
+	ctx context.Context, sys *types.SystemContext,
+) (types.ImageSource, error) {
+	src, err := b.Storage.NewImageSource(ctx, sys)
+	if err != nil {
+		return nil, err
+	}
+	return &bundleSource{ImageSource: src, ref: b}, nil
+}
+
+// bundleSource reads an image through a bundleReference.
+type bundleSource struct {
+	types.ImageSource
+	ref *bundleReference
+}
+
+// Reference returns the bundleReference the source was created from.
+func (b *bundleSource) Reference() types.ImageReference {
+	return b.ref
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+func TestPushResultStatus(t *testing.T) {
+	for name, tt := range map[string]struct {
+		result pushResult
+		status string
+	}{
+		"pushed": {
+			result: pushResult{pushed: true},
+			status: "pushed",
+		},
+		"failed": {
+			result: pushResult{err: errors.New("unauthorized")},
+			status: "failed",
+		},
+		"not attempted": {
+			result: pushResult{},
+			status: "skipped",
+		},
+		"canceled in flight": {
+			result: pushResult{err: fmt.Errorf("failed to copy: %w", context.Canceled)},
+			status: "skipped",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.status, tt.result.status())
+		})
+	}
+}
+
+func TestPrintPushReport(t *testing.T) {
+	for name, tt := range map[string]struct {
+		results []pushResult
+		err     string
+	}{
+		"all pushed": {
+			results: []pushResult{{image: "a:1", pushed: true}, {image: "b:1", pushed: true}},
+		},
+		"failed and canceled": {
+			results: []pushResult{
+				{image: "a:1", pushed: true},
+				{image: "b:1", err: errors.New("unauthorized")},
+				{image: "c:1", err: fmt.Errorf("failed to copy: %w", context.Canceled)},
+				{image: "d:1"},
+			},
+			err: "failed to push 1 image(s), 2 skipped",
+		},
+		"aborted": {
+			results: []pushResult{
+				{image: "a:1", err: fmt.Errorf("failed to copy: %w", context.Canceled)},
+			},
+			err: "push aborted, 1 image(s) skipped",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			err := printPushReport(tt.results)
+			if tt.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tt.err)
+		})
+	}
+}
+
+func TestBundleReference(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	store := storage.New(tmpdir)
+	raw := newTestImage(t, "linux", "amd64").manifest
+	pinned := "quay.io/org/app:1@" + digest.FromBytes(raw).String()
+	for _, tt := range []struct {
+		image      string
+		identity   string
+		namespaces []string
+	}{
+		{
+			image:      "quay.io/org/app:1",
+			identity:   "quay.io/org/app:1",
+			namespaces: []string{"quay.io/org/app", "quay.io/org", "quay.io"},
+		},
+		{
+			image:      "alpine:latest",
+			identity:   "docker.io/library/alpine:latest",
+			namespaces: []string{"docker.io/library/alpine", "docker.io/library", "docker.io"},
+		},
+		{
+			image:      pinned,
+			identity:   "quay.io/org/app@" + digest.FromBytes(raw).String(),
+			namespaces: []string{"quay.io/org/app", "quay.io/org", "quay.io"},
+		},
+	} {
+		t.Run(tt.image, func(t *testing.T) {
+			stored, err := store.Reference(tt.image)
+			assert.NoError(t, err)
+			dst, err := stored.NewImageDestination(ctx, nil)
+			assert.NoError(t, err)
+			assert.NoError(t, dst.PutManifest(ctx, raw, nil))
+			assert.NoError(t, dst.Commit(ctx, nil))
+
+			ref, err := newBundleReference(stored, tt.image)
+			assert.NoError(t, err)
+			assert.Equal(t, transportDocker, ref.Transport().Name())
+			assert.Equal(t, tt.identity, ref.DockerReference().String())
+			assert.Equal(t, tt.identity, ref.PolicyConfigurationIdentity())
+			assert.Subset(t, ref.PolicyConfigurationNamespaces(), tt.namespaces)
+
+			// policies are checked against the reference of the
+			// source, the image itself is read from the bundle.
+			src, err := ref.NewImageSource(ctx, nil)
+			assert.NoError(t, err)
+			defer src.Close()
+			assert.Equal(t, ref, src.Reference())
+			manifest, _, err := src.GetManifest(ctx, nil)
+			assert.NoError(t, err)
+			assert.Equal(t, raw, manifest)
+		})
+	}
+
+	_, err = newBundleReference(store, "quay.io/org/app 1")
+	assert.ErrorContains(t, err, "invalid image name quay.io/org/app 1")
+}
+
+func TestVerifiedAttachments(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+
+	store := storage.New(tmpdir)
+	put := func(image string, raw []byte) {
+		stored, err := store.Reference(image)
+		assert.NoError(t, err)
+		dst, err := stored.NewImageDestination(ctx, nil)
+		assert.NoError(t, err)
+		assert.NoError(t, dst.PutManifest(ctx, raw, nil))
+		assert.NoError(t, dst.Commit(ctx, nil))
+	}
+	referrer := func(subject digest.Digest) []byte {
+		raw, err := json.Marshal(map[string]any{
+			"schemaVersion": 2,
+			"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+			"subject":       map[string]any{"digest": subject},
+		})
+		assert.NoError(t, err)
+		return raw
+	}
+
+	subject := newTestImage(t, "linux", "amd64").manifest
+	dgst := digest.FromBytes(subject)
+	other := digest.FromString("other")
+	put("quay.io/org/app:v1", subject)
+	attached := referrer(dgst)
+	unrelated := referrer(other)
+	index := &storage.Index{Images: []storage.IndexImage{{Reference: "quay.io/org/app:v1"}}}
+	expected := map[string]bool{}
+	for _, tt := range []struct {
+		image    string
+		raw      []byte
+		verified bool
+	}{
+		{image: "quay.io/org/app:" + attachmentTag(dgst, ".sig"), raw: subject, verified: true},
+		{image: "quay.io/org/app:" + attachmentTag(dgst, ".sbom"), raw: subject, verified: true},
+		{image: "quay.io/org/app:" + attachmentTag(dgst, referrersSuffix), raw: subject, verified: true},
+		{image: "quay.io/org/app@" + digest.FromBytes(attached).String(), raw: attached, verified: true},
+		// forged entries claiming to be attached to app:v1.
+		{image: "quay.io/org/app:v2", raw: subject},
+		{image: "quay.io/org/app:" + attachmentTag(other, ".sig"), raw: subject},
+		{image: "quay.io/org/app@" + digest.FromBytes(unrelated).String(), raw: unrelated},
+		{image: "quay.io/org/app@" + digest.FromBytes(subject).String(), raw: attached},
+	} {
+		put(tt.image, tt.raw)
+		index.Images = append(index.Images, storage.IndexImage{
+			Reference: tt.image,
+			Subject:   "quay.io/org/app:v1",
+		})
+		expected[tt.image] = tt.verified
+	}
+	assert.NoError(t, store.WriteIndex(index))
+
+	subjects, err := attachmentSubjects(store)
+	assert.NoError(t, err)
+	assert.Len(t, subjects, len(expected))
+	verified, err := verifiedAttachments(ctx, store, subjects)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, verified)
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/pkg/docker/config"
+	"go.podman.io/image/v5/pkg/sysregistriesv2"
+	"go.podman.io/image/v5/pkg/tlsclientconfig"
+	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+// referrersMediaType is the media type of the index returned by the OCI
+// referrers API.
+const referrersMediaType = "application/vnd.oci.image.index.v1+json"
+
+// errReferrersUnsupported is returned by listReferrers when the registry
+// does not implement the OCI referrers API.
+var errReferrersUnsupported = errors.New("referrers api not supported")
+
+// certsDirs are the directories, below the user home directory for the
+// first one, holding per registry certificates as in containers-certs.d.
+var certsDirs = []string{
+	".config/containers/certs.d",
+	"/etc/containers/certs.d",
+	"/etc/docker/certs.d",
+}
+
+// registryHost returns the host serving the registry repo belongs to.
+func registryHost(repo reference.Named) string {
+	host := reference.Domain(repo)
+	if host == "docker.io" {
+		return "registry-1.docker.io"
+	}
+	return host
+}
+
+// listReferrers returns the descriptors of the manifests referring, through
+// their subject, to the manifest with digest dgst in repo as reported by the
+// OCI referrers API (/v2/<name>/referrers/<digest>). Returns
+// errReferrersUnsupported if the registry does not implement the API,
+// callers are then expected to fall back to the referrers tag schema (see
+// attachmentTag). As when pulling the image, the mirrors configured in
+// registries.conf are queried first and the first answer is used,
+// credentials, certificates, TLS verification and proxy follow sys.
+func listReferrers(
+	ctx context.Context, repo reference.Named, dgst digest.Digest, sys *types.SystemContext,
+) ([]storage.OCIDescriptor, error) {
+	pinned, err := reference.WithDigest(repo, dgst)
+	if err != nil {
+		return nil, fmt.Errorf("invalid digest %s: %w", dgst, err)
+	}
+	registry, err := sysregistriesv2.FindRegistry(sys, pinned.Name())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read registries configuration: %w", err)
+	}
+	sources := []sysregistriesv2.PullSource{{Reference: pinned}}
+	if registry != nil {
+		if registry.Blocked {
+			return nil, fmt.Errorf("registry %s is blocked", registry.Prefix)
+		}
+		if sources, err = registry.PullSourcesFromReference(pinned); err != nil {
+			return nil, fmt.Errorf("failed to list mirrors: %w", err)
+		}
+	}
+	for _, source := range sources {
+		endpoint := reference.TrimNamed(source.Reference)
+		endsys := sys
+		// credentials provided for the image are not sent to mirrors.
+		mirror := reference.Domain(endpoint) != reference.Domain(repo)
+		if mirror && sys != nil && sys.DockerAuthConfig != nil {
+			nocreds := *sys
+			nocreds.DockerAuthConfig = nil
+			endsys = &nocreds
+		}
+		var referrers []storage.OCIDescriptor
+		if referrers, err = endpointReferrers(
+			ctx, endpoint, dgst, source.Endpoint.Insecure, endsys,
+		); err == nil {
+			return referrers, nil
+		}
+	}
+	return nil, err
+}
+
+// endpointReferrers lists the referrers of dgst in repo, served by the
+// registry endpoint repo points to. Certificates of insecure endpoints, as
+// configured in registries.conf unless sys says otherwise, are not verified
+// and these are queried over http if https fails.
+func endpointReferrers(
+	ctx context.Context,
+	repo reference.Named,
+	dgst digest.Digest,
+	insecure bool,
+	sys *types.SystemContext,
+) ([]storage.OCIDescriptor, error) {
+	if sys != nil && sys.DockerInsecureSkipTLSVerify != types.OptionalBoolUndefined {
+		insecure = sys.DockerInsecureSkipTLSVerify == types.OptionalBoolTrue
+	}
+	client, err := registryClient(reference.Domain(repo), insecure, sys)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := referrersResponse(ctx, client, insecure, repo, dgst, sys)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, errReferrersUnsupported
+	default:
+		return nil, fmt.Errorf("failed to list referrers: unexpected status %s", resp.Status)
+	}
+	// registries lacking the api may answer with an unrelated document.
+	mediatype, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediatype != referrersMediaType {
+		return nil, errReferrersUnsupported
+	}
+	var index storage.OCIIndex
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxConfigSize)).Decode(&index); err != nil {
+		return nil, fmt.Errorf("failed to parse referrers: %w", err)
+	}
+	return index.Manifests, nil
+}
+
+// referrersResponse requests the referrers of dgst in repo, over http if
+// the registry is insecure and can't be reached over https, authenticating
+// if the registry asks to. Callers must close the response body.
+func referrersResponse(
+	ctx context.Context,
+	client *http.Client,
+	insecure bool,
+	repo reference.Named,
+	dgst digest.Digest,
+	sys *types.SystemContext,
+) (*http.Response, error) {
+	path := fmt.Sprintf("%s/v2/%s/referrers/%s", registryHost(repo), reference.Path(repo), dgst)
+	endpoint := "https://" + path
+	resp, err := referrersRequest(ctx, client, endpoint, "")
+	if err != nil && insecure {
+		endpoint = "http://" + path
+		resp, err = referrersRequest(ctx, client, endpoint, "")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	auth, err := registryAuth(ctx, client, challenge, repo, sys)
+	if err != nil {
+		return nil, err
+	}
+	return referrersRequest(ctx, client, endpoint, auth)
+}
+
+// registryClient returns an http client for the registry served at host.
+// Certificates are read, as containers/image does, from sys.DockerCertPath
+// or from the host directory in sys.DockerPerHostCertDirPath or in the
+// first of certsDirs holding one. Requests go through sys.DockerProxyURL or
+// the proxy set in the environment.
+func registryClient(host string, insecure bool, sys *types.SystemContext) (*http.Client, error) {
+	dir, err := registryCertsDir(host, sys)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{InsecureSkipVerify: insecure}
+	if err := tlsclientconfig.SetupCertificates(dir, config); err != nil {
+		return nil, fmt.Errorf("failed to read certificates for %s: %w", host, err)
+	}
+	transport := &http.Transport{
+		Proxy:           http.ProxyFromEnvironment,
+		TLSClientConfig: config,
+	}
+	if sys != nil && sys.DockerProxyURL != nil {
+		transport.Proxy = http.ProxyURL(sys.DockerProxyURL)
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// registryCertsDir returns the directory holding the certificates for the
+// registry served at host, see registryClient.
+func registryCertsDir(host string, sys *types.SystemContext) (string, error) {
+	if sys != nil && sys.DockerCertPath != "" {
+		return sys.DockerCertPath, nil
+	}
+	if sys != nil && sys.DockerPerHostCertDirPath != "" {
+		return filepath.Join(sys.DockerPerHostCertDirPath, host), nil
+	}
+	var dir string
+	for i, base := range certsDirs {
+		if i == 0 {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				continue
+			}
+			base = filepath.Join(home, base)
+		} else if sys != nil && sys.RootForImplicitAbsolutePaths != "" {
+			base = filepath.Join(sys.RootForImplicitAbsolutePaths, base)
+		}
+		dir = filepath.Join(base, host)
+		if _, err := os.Stat(dir); err == nil {
+			break
+		} else if !os.IsNotExist(err) && !os.IsPermission(err) {
+			return "", fmt.Errorf("failed to stat %s: %w", dir, err)
+		}
+	}
+	return dir, nil
+}
+
+// referrersRequest sends a request for the referrers index to endpoint with
+// the provided authorization header, if any.
+func referrersRequest(
+	ctx context.Context, client *http.Client, endpoint, auth string,
+) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Accept", referrersMediaType)
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list referrers: %w", err)
+	}
+	return resp, nil
+}
+
+// registryAuth returns the authorization header answering the provided
+// WWW-Authenticate challenge for pulling from repo. Basic challenges are
+// answered with the credentials configured for the registry, bearer ones
+// with a token obtained from the realm the challenge points to.
+func registryAuth(
+	ctx context.Context,
+	client *http.Client,
+	challenge string,
+	repo reference.Named,
+	sys *types.SystemContext,
+) (string, error) {
+	var creds types.DockerAuthConfig
+	if sys != nil && sys.DockerAuthConfig != nil {
+		creds = *sys.DockerAuthConfig
+	} else {
+		var err error
+		if creds, err = config.GetCredentials(sys, reference.Domain(repo)); err != nil {
+			return "", fmt.Errorf("failed to read credentials: %w", err)
+		}
+	}
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if creds.Username == "" {
+			return "", fmt.Errorf("registry requires credentials")
+		}
+		req := &http.Request{Header: http.Header{}}
+		req.SetBasicAuth(creds.Username, creds.Password)
+		return req.Header.Get("Authorization"), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || realm.Host == "" {
+		return "", fmt.Errorf("invalid authentication realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	query.Set("scope", fmt.Sprintf("repository:%s:pull", reference.Path(repo)))
+	realm.RawQuery = query.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %w", err)
+	}
+	if creds.Username != "" {
+		req.SetBasicAuth(creds.Username, creds.Password)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request token: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to request token: unexpected status %s", resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxConfigSize)).Decode(&token); err != nil {
+		return "", fmt.Errorf("failed to parse token: %w", err)
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("registry returned an empty token")
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, e.g. `Bearer
+// realm="https://auth.example.com/token",service="registry"`, into its
+// scheme and parameters. Quoted values may contain commas.
+func parseChallenge(header string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	params := map[string]string{}
+	for rest = strings.TrimSpace(rest); rest != ""; {
+		key, value, found := strings.Cut(rest, "=")
+		if !found {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end == -1 {
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+			params[key] = strings.TrimSpace(params[key])
+		}
+		rest = strings.TrimLeft(rest, ", ")
+	}
+	return scheme, params
+}
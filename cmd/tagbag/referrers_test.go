@@ -0,0 +1,295 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+func TestParseChallenge(t *testing.T) {
+	for _, tt := range []struct {
+		header string
+		scheme string
+		params map[string]string
+	}{
+		{
+			header: `Bearer realm="https://auth.example.com/token",service="registry.example.com"`,
+			scheme: "Bearer",
+			params: map[string]string{
+				"realm":   "https://auth.example.com/token",
+				"service": "registry.example.com",
+			},
+		},
+		{
+			header: `Bearer realm="https://auth.example.com/token", scope="repository:org/app:pull,push"`,
+			scheme: "Bearer",
+			params: map[string]string{
+				"realm": "https://auth.example.com/token",
+				"scope": "repository:org/app:pull,push",
+			},
+		},
+		{
+			header: `Basic realm=registry`,
+			scheme: "Basic",
+			params: map[string]string{"realm": "registry"},
+		},
+		{
+			header: `Basic`,
+			scheme: "Basic",
+			params: map[string]string{},
+		},
+	} {
+		t.Run(tt.header, func(t *testing.T) {
+			scheme, params := parseChallenge(tt.header)
+			assert.Equal(t, tt.scheme, scheme)
+			assert.Equal(t, tt.params, params)
+		})
+	}
+}
+
+func TestListReferrers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	subject := digest.FromString("subject")
+	referrer := storage.OCIDescriptor{
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Digest:    digest.FromString("referrer"),
+		Size:      100,
+	}
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			user, pass, _ := r.BasicAuth()
+			if user != "user" || pass != "pass" || r.URL.Query().Get("scope") != "repository:org/app:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "secret"})
+		case "/v2/org/app/referrers/" + subject.String():
+			if r.Header.Get("Authorization") != "Bearer secret" {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test"`)
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", referrersMediaType)
+			json.NewEncoder(w).Encode(storage.OCIIndex{
+				SchemaVersion: 2,
+				MediaType:     referrersMediaType,
+				Manifests:     []storage.OCIDescriptor{referrer},
+			})
+		case "/v2/org/broken/referrers/" + subject.String():
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/v2/org/html/referrers/" + subject.String():
+			w.Header().Set("Content-Type", "text/html")
+			w.Write([]byte("<html></html>"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+	dir, err := os.MkdirTemp("", "tagbag-referrers-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "registries.conf")
+	assert.NoError(t, os.WriteFile(conf, nil, 0o600))
+	sys := &types.SystemContext{
+		SystemRegistriesConfPath:    conf,
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+		DockerAuthConfig:            &types.DockerAuthConfig{Username: "user", Password: "pass"},
+	}
+
+	repo, err := reference.ParseNormalizedNamed(host + "/org/app")
+	assert.NoError(t, err)
+	referrers, err := listReferrers(ctx, repo, subject, sys)
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.OCIDescriptor{referrer}, referrers)
+
+	for _, name := range []string{"/org/missing", "/org/html"} {
+		repo, err := reference.ParseNormalizedNamed(host + name)
+		assert.NoError(t, err)
+		_, err = listReferrers(ctx, repo, subject, sys)
+		assert.ErrorIs(t, err, errReferrersUnsupported)
+	}
+
+	// failures other than a missing api are not mistaken for one.
+	broken, err := reference.ParseNormalizedNamed(host + "/org/broken")
+	assert.NoError(t, err)
+	_, err = listReferrers(ctx, broken, subject, sys)
+	assert.ErrorContains(t, err, "unexpected status 500")
+	assert.NotErrorIs(t, err, errReferrersUnsupported)
+
+	sys.DockerAuthConfig = &types.DockerAuthConfig{Username: "user", Password: "wrong"}
+	_, err = listReferrers(ctx, repo, subject, sys)
+	assert.ErrorContains(t, err, "failed to request token")
+	assert.NotErrorIs(t, err, errReferrersUnsupported)
+}
+
+func TestListReferrersMirrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	subject := digest.FromString("subject")
+	referrer := storage.OCIDescriptor{
+		MediaType: "application/vnd.oci.image.manifest.v1+json",
+		Digest:    digest.FromString("referrer"),
+		Size:      100,
+	}
+	serve := func(path string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path+subject.String() {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", referrersMediaType)
+			json.NewEncoder(w).Encode(storage.OCIIndex{
+				SchemaVersion: 2,
+				MediaType:     referrersMediaType,
+				Manifests:     []storage.OCIDescriptor{referrer},
+			})
+		}))
+	}
+	primary := serve("/v2/org/app/referrers/")
+	defer primary.Close()
+	mirror := serve("/v2/cache/app/referrers/")
+	defer mirror.Close()
+	primaryHost := strings.TrimPrefix(primary.URL, "http://")
+	mirrorHost := strings.TrimPrefix(mirror.URL, "http://")
+
+	dir, err := os.MkdirTemp("", "tagbag-referrers-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// registries configurations are cached by path, each case has its own.
+	configure := func(name, primaryHost string) *types.SystemContext {
+		conf := filepath.Join(dir, name)
+		assert.NoError(t, os.WriteFile(conf, []byte(`
+[[registry]]
+location = "`+primaryHost+`/org"
+insecure = true
+
+[[registry.mirror]]
+location = "`+mirrorHost+`/cache"
+insecure = true
+`), 0o600))
+		return &types.SystemContext{SystemRegistriesConfPath: conf}
+	}
+
+	// the mirror answers first, over http as it is insecure.
+	repo, err := reference.ParseNormalizedNamed(primaryHost + "/org/app")
+	assert.NoError(t, err)
+	primary.Close()
+	referrers, err := listReferrers(ctx, repo, subject, configure("mirror.conf", primaryHost))
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.OCIDescriptor{referrer}, referrers)
+
+	// repositories missing in the mirror are looked up in the primary.
+	other := serve("/v2/org/other/referrers/")
+	defer other.Close()
+	otherHost := strings.TrimPrefix(other.URL, "http://")
+	repo, err = reference.ParseNormalizedNamed(otherHost + "/org/other")
+	assert.NoError(t, err)
+	referrers, err = listReferrers(ctx, repo, subject, configure("primary.conf", otherHost))
+	assert.NoError(t, err)
+	assert.Equal(t, []storage.OCIDescriptor{referrer}, referrers)
+
+	// registries not configured as insecure are not queried over http.
+	conf := filepath.Join(dir, "empty.conf")
+	assert.NoError(t, os.WriteFile(conf, nil, 0o600))
+	_, err = listReferrers(ctx, repo, subject, &types.SystemContext{SystemRegistriesConfPath: conf})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, errReferrersUnsupported)
+}
+
+func TestListReferrersProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	subject := digest.FromString("subject")
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.Method+" "+r.Host)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	assert.NoError(t, err)
+
+	dir, err := os.MkdirTemp("", "tagbag-referrers-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conf := filepath.Join(dir, "registries.conf")
+	assert.NoError(t, os.WriteFile(conf, nil, 0o600))
+	sys := &types.SystemContext{
+		SystemRegistriesConfPath:    conf,
+		DockerInsecureSkipTLSVerify: types.OptionalBoolTrue,
+		DockerProxyURL:              proxyURL,
+	}
+	repo, err := reference.ParseNormalizedNamed("registry.invalid/org/app")
+	assert.NoError(t, err)
+	_, err = listReferrers(ctx, repo, subject, sys)
+	assert.ErrorIs(t, err, errReferrersUnsupported)
+	assert.Equal(t, []string{"CONNECT registry.invalid:443", "GET registry.invalid"}, proxied)
+}
+
+func TestRegistryCertsDir(t *testing.T) {
+	home, err := os.MkdirTemp("", "tagbag-home-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	t.Setenv("HOME", home)
+	root, err := os.MkdirTemp("", "tagbag-root-*")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+
+	sys := &types.SystemContext{RootForImplicitAbsolutePaths: root}
+	dir, err := registryCertsDir("quay.io", sys)
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "/etc/docker/certs.d/quay.io"), dir)
+
+	etc := filepath.Join(root, "/etc/containers/certs.d/quay.io")
+	assert.NoError(t, os.MkdirAll(etc, 0o700))
+	dir, err = registryCertsDir("quay.io", sys)
+	assert.NoError(t, err)
+	assert.Equal(t, etc, dir)
+
+	user := filepath.Join(home, ".config/containers/certs.d/quay.io")
+	assert.NoError(t, os.MkdirAll(user, 0o700))
+	dir, err = registryCertsDir("quay.io", sys)
+	assert.NoError(t, err)
+	assert.Equal(t, user, dir)
+
+	sys.DockerPerHostCertDirPath = "/certs"
+	dir, err = registryCertsDir("quay.io", sys)
+	assert.NoError(t, err)
+	assert.Equal(t, "/certs/quay.io", dir)
+
+	sys.DockerCertPath = "/quay-certs"
+	dir, err = registryCertsDir("quay.io", sys)
+	assert.NoError(t, err)
+	assert.Equal(t, "/quay-certs", dir)
+}
+
+func TestRegistryHost(t *testing.T) {
+	for name, host := range map[string]string{
+		"alpine":                 "registry-1.docker.io",
+		"docker.io/org/app":      "registry-1.docker.io",
+		"quay.io/org/app":        "quay.io",
+		"localhost:5000/org/app": "localhost:5000",
+	} {
+		repo, err := reference.ParseNormalizedNamed(name)
+		assert.NoError(t, err)
+		assert.Equal(t, host, registryHost(repo))
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"archive/tar"
+	_ "embed"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+
+	"github.com/docker/go-units"
+	"github.com/urfave/cli/v2"
+
+	"github.com/ricardomaraschini/tagbag/signing"
+	"github.com/ricardomaraschini/tagbag/storage"
+	"github.com/ricardomaraschini/tagbag/tgz"
+)
+
+// signatureSuffix is appended to the tarball path to obtain the path of its
+// detached signature.
+const signatureSuffix = ".sig"
+
+//go:embed static/sign-usage.txt
+var signUsageText string
+
+var signCommand = &cli.Command{
+	Name:      "sign",
+	Usage:     "Signs the index of a tarball",
+	UsageText: signUsageText,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "source",
+			Required: true,
+			Aliases:  []string{"s"},
+			Usage:    "Source tarball path",
+		},
+		&cli.StringFlag{
+			Name:     "key",
+			Required: true,
+			Aliases:  []string{"k"},
+			Usage:    "Private key (ed25519 or ECDSA, PEM encoded) to sign with",
+		},
+		&cli.BoolFlag{
+			Name:  "detached",
+			Usage: "Write the signature next to the tarball instead of embedding it",
+			Value: false,
+		},
+		&cli.StringSliceFlag{
+			Name:  "decrypt-key",
+			Usage: "File with the age identities to decrypt encrypted tarballs with",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "File with the passphrase to decrypt encrypted tarballs with",
+		},
+		&cli.StringFlag{
+			Name:  "temp",
+			Usage: "Temporary directory to use",
+			Value: "/tmp",
+		},
+		&cli.StringFlag{
+			Name:  "max-size",
+			Usage: "Maximum size of the extracted tarball",
+			Value: "1TiB",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		key, err := signing.LoadPrivateKey(c.String("key"))
+		if err != nil {
+			return err
+		}
+		decrypt, err := decryptionOptions(c)
+		if err != nil {
+			return err
+		}
+		source := c.String("source")
+		index, err := readBundleFile(source, storage.IndexPath, decrypt)
+		if err != nil {
+			return err
+		}
+		if index == nil {
+			return fmt.Errorf("%s has no index, pull it again to sign it", source)
+		}
+		signature, err := signing.Sign(key, index)
+		if err != nil {
+			return err
+		}
+		if c.Bool("detached") {
+			fpath := source + signatureSuffix
+			fmt.Println("Writing file", fpath)
+			if err := os.WriteFile(fpath, signature, 0644); err != nil {
+				return fmt.Errorf("failed to write signature: %w", err)
+			}
+			return nil
+		}
+
+		if _, err := os.Stat(source); os.IsNotExist(err) {
+			// the tarball is split into volumes, rewriting it would
+			// require knowing the size they were split at.
+			return fmt.Errorf("%s is split into volumes, use --detached to sign it", source)
+		}
+		// the signed tarball would have to be encrypted again, to
+		// recipients we don't know.
+		if encrypted, err := tgz.Encrypted(source); err != nil {
+			return err
+		} else if encrypted {
+			return fmt.Errorf("%s is encrypted, use --detached to sign it", source)
+		}
+		maxsize, err := units.RAMInBytes(c.String("max-size"))
+		if err != nil {
+			return fmt.Errorf("invalid max size: %w", err)
+		}
+		codec, err := tgz.DetectCodec(source)
+		if err != nil {
+			return err
+		}
+		tempdir, err := os.MkdirTemp(c.String("temp"), "tagbag-*")
+		if err != nil {
+			return fmt.Errorf("failed to create %s directory: %w", tempdir, err)
+		}
+		defer os.RemoveAll(tempdir)
+		fmt.Println("Extracting", source)
+		if err := tgz.Uncompress(source, tempdir, tgz.WithMaxSize(maxsize)); err != nil {
+			return fmt.Errorf("failed to uncompress tarball: %w", err)
+		}
+		sigpath := path.Join(tempdir, storage.IndexSignaturePath)
+		if err := os.WriteFile(sigpath, signature, 0600); err != nil {
+			return fmt.Errorf("failed to write signature: %w", err)
+		}
+		// the signed tarball replaces the original one only once it has
+		// been completely written.
+		output := source + ".tmp"
+		fmt.Println("Writing file", source)
+		if err := tgz.Compress(tempdir, output, tgz.WithCodec(codec)); err != nil {
+			os.Remove(output)
+			return fmt.Errorf("failed to compress tarball: %w", err)
+		}
+		if err := os.Rename(output, source); err != nil {
+			os.Remove(output)
+			return fmt.Errorf("failed to replace tarball: %w", err)
+		}
+		return nil
+	},
+}
+
+// errFound stops walking a tarball once the searched file has been found.
+var errFound = errors.New("found")
+
+// readBundleFile returns the content of the file with the provided name
+// stored in the tarball, read with opts. Returns nil if the tarball does not
+// contain it.
+func readBundleFile(source, name string, opts []tgz.Option) ([]byte, error) {
+	var data []byte
+	err := tgz.Walk(source, func(header *tar.Header, content io.Reader) error {
+		if header.Typeflag != tar.TypeReg || path.Clean(header.Name) != name {
+			return nil
+		}
+		var err error
+		if data, err = io.ReadAll(content); err != nil {
+			return fmt.Errorf("failed to read %s: %w", name, err)
+		}
+		return errFound
+	}, opts...)
+	if err != nil && !errors.Is(err, errFound) {
+		return nil, fmt.Errorf("failed to read tarball: %w", err)
+	}
+	return data, nil
+}
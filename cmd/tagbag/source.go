@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+
+	"go.podman.io/image/v5/docker/reference"
+	"go.podman.io/image/v5/transports/alltransports"
+	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+	"github.com/ricardomaraschini/tagbag/tgz"
+)
+
+// pullSource is an image to be pulled into a bundle.
+type pullSource struct {
+	// name is the name the image is stored under in the bundle.
+	name string
+	// ref is the reference the image is pulled from.
+	ref types.ImageReference
+	// pinned is set for images pinned by digest, these are pulled with
+	// all their instances so the pinned digest is preserved.
+	pinned bool
+}
+
+// parseSource parses an image given to pull. Images are either docker
+// references (alpine:latest) or references prefixed by any transport known
+// to containers/image (docker-archive:/tmp/app.tar, dir:/tmp/app, etc). The
+// name the image is stored under can be set by appending "=NAME", this is
+// required for references that do not carry an image name.
+func parseSource(value string) (pullSource, error) {
+	var name string
+	if idx := strings.LastIndex(value, "="); idx != -1 {
+		value, name = value[:idx], value[idx+1:]
+	}
+	if alltransports.TransportFromImageName(value) == nil {
+		return parseDockerSource(value, name)
+	}
+	ref, err := alltransports.ParseImageName(value)
+	if err != nil {
+		return pullSource{}, fmt.Errorf("failed to parse %s: %w", value, err)
+	}
+	source := pullSource{name: name, ref: ref}
+	if named := ref.DockerReference(); named != nil {
+		if _, ok := named.(reference.Canonical); ok {
+			source.pinned = true
+		}
+		if source.name == "" {
+			source.name = named.String()
+		}
+	}
+	if source.name == "" {
+		return pullSource{}, fmt.Errorf(
+			"unable to infer the name of %s, append =NAME to set it", value,
+		)
+	}
+	if _, err := reference.ParseNormalizedNamed(source.name); err != nil {
+		return pullSource{}, fmt.Errorf("invalid image name %s: %w", source.name, err)
+	}
+	return source, nil
+}
+
+// parseDockerSource parses a docker reference without transport prefix.
+// References with both a tag and a digest are pulled by digest as the
+// docker transport does not support both. The image is stored under the
+// reference as provided unless name is set.
+func parseDockerSource(value, name string) (pullSource, error) {
+	named, err := reference.ParseNormalizedNamed(value)
+	if err != nil {
+		return pullSource{}, fmt.Errorf("failed to parse %s: %w", value, err)
+	}
+	if name == "" {
+		name = value
+	} else if _, err := reference.ParseNormalizedNamed(name); err != nil {
+		return pullSource{}, fmt.Errorf("invalid image name %s: %w", name, err)
+	}
+	var pinned bool
+	if canonical, ok := named.(reference.Canonical); ok {
+		if named, err = reference.WithDigest(
+			reference.TrimNamed(canonical), canonical.Digest(),
+		); err != nil {
+			return pullSource{}, fmt.Errorf("failed to parse %s: %w", value, err)
+		}
+		pinned = true
+	}
+	withproto := fmt.Sprintf("docker://%s", named.String())
+	ref, err := alltransports.ParseImageName(withproto)
+	if err != nil {
+		return pullSource{}, fmt.Errorf("failed parse %s transport: %w", value, err)
+	}
+	return pullSource{name: name, ref: ref, pinned: pinned}, nil
+}
+
+// parseSources parses all images given to pull. Images given more than once
+// are pulled only once, different images can't be stored under the same
+// name.
+func parseSources(values []string) ([]pullSource, error) {
+	var sources []pullSource
+	seen := map[string]string{}
+	for _, value := range values {
+		source, err := parseSource(value)
+		if err != nil {
+			return nil, err
+		}
+		refname := source.ref.Transport().Name() + ":" + source.ref.StringWithinTransport()
+		if previous, ok := seen[source.name]; ok {
+			if previous != refname {
+				return nil, fmt.Errorf(
+					"images %s and %s are both named %s", previous, refname, source.name,
+				)
+			}
+			continue
+		}
+		seen[source.name] = refname
+		sources = append(sources, source)
+	}
+	return sources, nil
+}
+
+// archiveSources returns the images stored in a docker-archive (as created
+// by docker save) or oci-archive tarball, in the format expected by
+// parseSource. The value is the tarball path optionally followed by
+// "=REPOSITORY". Images are named after their tags (docker-archive) or their
+// reference name annotation (oci-archive). Annotations are often just a tag
+// (e.g. "latest"), these are combined with the repository which is then
+// required.
+func archiveSources(value string) ([]string, error) {
+	fpath, repository := value, ""
+	if idx := strings.LastIndex(value, "="); idx != -1 {
+		fpath, repository = value[:idx], value[idx+1:]
+	}
+	var repo reference.Named
+	if repository != "" {
+		named, err := reference.ParseNormalizedNamed(repository)
+		if err != nil || !reference.IsNameOnly(named) {
+			return nil, fmt.Errorf("invalid repository %s for %s", repository, fpath)
+		}
+		repo = named
+	}
+	var docker []struct {
+		RepoTags []string `json:"RepoTags"`
+	}
+	var oci *storage.OCIIndex
+	if err := tgz.Walk(fpath, func(header *tar.Header, content io.Reader) error {
+		switch path.Clean(header.Name) {
+		case "manifest.json":
+			if err := json.NewDecoder(content).Decode(&docker); err != nil {
+				return fmt.Errorf("failed to parse manifest: %w", err)
+			}
+		case storage.OCIIndexFile:
+			oci = &storage.OCIIndex{}
+			if err := json.NewDecoder(content).Decode(oci); err != nil {
+				return fmt.Errorf("failed to parse index: %w", err)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", fpath, err)
+	}
+	var images []string
+	switch {
+	case docker != nil:
+		for i, entry := range docker {
+			if len(entry.RepoTags) == 0 {
+				return nil, fmt.Errorf(
+					"image %d in %s is not tagged, use --image docker-archive:%s:@%d=NAME",
+					i, fpath, fpath, i,
+				)
+			}
+			for _, tag := range entry.RepoTags {
+				images = append(images, fmt.Sprintf("docker-archive:%s:%s=%s", fpath, tag, tag))
+			}
+		}
+	case oci != nil:
+		for i, descriptor := range oci.Manifests {
+			refname, ok := descriptor.Annotations[storage.AnnotationRefName]
+			if !ok {
+				return nil, fmt.Errorf(
+					"image %d in %s is not named, use --image oci-archive:%s:@%d=NAME",
+					i, fpath, fpath, i,
+				)
+			}
+			name := refname
+			if !strings.ContainsAny(refname, "/:@") {
+				if repo == nil {
+					return nil, fmt.Errorf(
+						"image %d in %s is named %s, not a full reference, use --from-archive %s=REPOSITORY",
+						i, fpath, refname, fpath,
+					)
+				}
+				tagged, err := reference.WithTag(repo, refname)
+				if err != nil {
+					return nil, fmt.Errorf("invalid tag %s in %s: %w", refname, fpath, err)
+				}
+				name = reference.FamiliarString(tagged)
+			}
+			images = append(images, fmt.Sprintf("oci-archive:%s:%s=%s", fpath, refname, name))
+		}
+	default:
+		return nil, fmt.Errorf("%s is neither a docker-archive nor an oci-archive", fpath)
+	}
+	return images, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+// ociArchive writes an oci-archive whose index names each image with the
+// provided reference name annotation and returns its path.
+func ociArchive(t *testing.T, refnames ...string) string {
+	index := storage.OCIIndex{SchemaVersion: 2}
+	for _, refname := range refnames {
+		index.Manifests = append(index.Manifests, storage.OCIDescriptor{
+			MediaType:   "application/vnd.oci.image.manifest.v1+json",
+			Digest:      digest.FromString(refname),
+			Annotations: map[string]string{storage.AnnotationRefName: refname},
+		})
+	}
+	data, err := json.Marshal(index)
+	assert.NoError(t, err)
+	return writeBundle(t, map[string][]byte{
+		storage.OCILayoutFile: []byte(`{"imageLayoutVersion":"1.0.0"}`),
+		storage.OCIIndexFile:  data,
+	})
+}
+
+func TestArchiveSourcesDocker(t *testing.T) {
+	fpath := writeBundle(t, map[string][]byte{
+		"manifest.json": []byte(`[{"RepoTags":["quay.io/org/app:1","app:latest"]}]`),
+	})
+	images, err := archiveSources(fpath)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{
+		"docker-archive:" + fpath + ":quay.io/org/app:1=quay.io/org/app:1",
+		"docker-archive:" + fpath + ":app:latest=app:latest",
+	}, images)
+
+	fpath = writeBundle(t, map[string][]byte{
+		"manifest.json": []byte(`[{"RepoTags":[]}]`),
+	})
+	_, err = archiveSources(fpath)
+	assert.EqualError(
+		t, err,
+		"image 0 in "+fpath+" is not tagged, use --image docker-archive:"+fpath+":@0=NAME",
+	)
+}
+
+func TestArchiveSourcesOCI(t *testing.T) {
+	full := ociArchive(t, "quay.io/org/app:1", "app:2")
+	tags := ociArchive(t, "latest", "1.0")
+	for _, tt := range []struct {
+		name   string
+		value  string
+		images []string
+		err    string
+	}{
+		{
+			name:  "full references",
+			value: full,
+			images: []string{
+				"oci-archive:" + full + ":quay.io/org/app:1=quay.io/org/app:1",
+				"oci-archive:" + full + ":app:2=app:2",
+			},
+		},
+		{
+			name:  "full references with repository",
+			value: full + "=myorg/app",
+			images: []string{
+				"oci-archive:" + full + ":quay.io/org/app:1=quay.io/org/app:1",
+				"oci-archive:" + full + ":app:2=app:2",
+			},
+		},
+		{
+			name:  "tags with repository",
+			value: tags + "=quay.io/myorg/app",
+			images: []string{
+				"oci-archive:" + tags + ":latest=quay.io/myorg/app:latest",
+				"oci-archive:" + tags + ":1.0=quay.io/myorg/app:1.0",
+			},
+		},
+		{
+			name:  "tags with repository without registry host",
+			value: tags + "=myorg/app",
+			images: []string{
+				"oci-archive:" + tags + ":latest=myorg/app:latest",
+				"oci-archive:" + tags + ":1.0=myorg/app:1.0",
+			},
+		},
+		{
+			name:  "tags without repository",
+			value: tags,
+			err:   "image 0 in " + tags + " is named latest, not a full reference, use --from-archive " + tags + "=REPOSITORY",
+		},
+		{
+			name:  "tagged repository",
+			value: tags + "=myorg/app:1",
+			err:   "invalid repository myorg/app:1 for " + tags,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			images, err := archiveSources(tt.value)
+			if tt.err != "" {
+				assert.EqualError(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.images, images)
+		})
+	}
+}
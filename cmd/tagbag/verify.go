@@ -0,0 +1,138 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+)
+
+//go:embed static/verify-usage.txt
+var verifyUsageText string
+
+var verifyCommand = &cli.Command{
+	Name:      "verify",
+	Usage:     "Checks the integrity of all blobs in a tarball",
+	UsageText: verifyUsageText,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "source",
+			Required: true,
+			Aliases:  []string{"s"},
+			Usage:    "Source tarball path",
+		},
+		&cli.StringSliceFlag{
+			Name:    "overlay",
+			Aliases: []string{"o"},
+			Usage:   "Overlay tarball paths",
+		},
+		&cli.StringSliceFlag{
+			Name:  "decrypt-key",
+			Usage: "File with the age identities to decrypt encrypted tarballs with",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "File with the passphrase to decrypt encrypted tarballs with",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		opts, err := decryptionOptions(c)
+		if err != nil {
+			return err
+		}
+		scanner := newBundleScanner()
+		scanner.verify = true
+		scanner.opts = opts
+		sources := append([]string{c.String("source")}, c.StringSlice("overlay")...)
+		for _, source := range sources {
+			fmt.Println("Reading", source)
+			if err := scanner.scan(source); err != nil {
+				return fmt.Errorf("failed to read tarball: %w", err)
+			}
+		}
+		images, err := scanner.images()
+		if err != nil {
+			return fmt.Errorf("failed to process images: %w", err)
+		}
+
+		for fpath := range scanner.corrupt {
+			fmt.Println("Corrupt file", fpath)
+		}
+
+		var failed int
+		for _, result := range scanner.check(images) {
+			if len(result.problems) == 0 {
+				fmt.Println(result.name, "ok")
+				continue
+			}
+			failed++
+			fmt.Println(result.name, "failed")
+			for _, problem := range result.problems {
+				fmt.Println("  ", problem)
+			}
+		}
+
+		if failed > 0 || len(scanner.corrupt) > 0 {
+			return fmt.Errorf("verification failed for %d image(s)", failed)
+		}
+		fmt.Println("All", len(images), "images verified")
+		return nil
+	},
+}
+
+// imageCheck holds the problems found in a single image by check. An image
+// without problems is intact.
+type imageCheck struct {
+	name     string
+	problems []string
+}
+
+// check looks for problems in the provided images, obtained through images
+// from a scanner with verify set: missing child manifests, missing or
+// corrupt blobs and manifests not matching the index. Images listed in the
+// index but not found in the tarball are reported as missing. Results are
+// returned in the order of images, followed by the missing ones.
+func (b *bundleScanner) check(images []bundleImage) []imageCheck {
+	corrupt := map[digest.Digest]bool{}
+	for _, dgst := range b.corrupt {
+		corrupt[dgst] = true
+	}
+
+	var results []imageCheck
+	found := map[string]bool{}
+	for _, image := range images {
+		found[image.Name] = true
+		result := imageCheck{name: image.Name}
+		for _, dgst := range image.missing {
+			result.problems = append(result.problems, fmt.Sprintf("missing manifest %s", dgst))
+		}
+		for _, dgst := range image.blobs {
+			if corrupt[dgst] {
+				result.problems = append(result.problems, fmt.Sprintf("corrupt blob %s", dgst))
+			} else if _, ok := b.blobs[dgst]; !ok {
+				result.problems = append(result.problems, fmt.Sprintf("missing blob %s", dgst))
+			}
+		}
+		if b.index != nil {
+			indexed, ok := b.index.Image(image.Name)
+			if ok && indexed.Digest != image.Digest {
+				result.problems = append(result.problems, fmt.Sprintf("manifest digest mismatch %s", image.Digest))
+			}
+		}
+		results = append(results, result)
+	}
+
+	if b.index != nil {
+		for _, image := range b.index.Images {
+			if found[image.Reference] {
+				continue
+			}
+			results = append(results, imageCheck{
+				name:     image.Reference,
+				problems: []string{"missing image"},
+			})
+		}
+	}
+	return results
+}
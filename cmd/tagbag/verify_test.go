@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"path"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+func TestCheck(t *testing.T) {
+	image := newTestImage(t, "linux", "amd64")
+	blobs := path.Join(storage.BlobsDir, "sha256")
+	config := path.Join(blobs, digest.FromBytes(image.config).Encoded())
+	layer := path.Join(blobs, digest.FromBytes(image.layer).Encoded())
+	for name, tt := range map[string]struct {
+		mutate   func(files map[string][]byte)
+		corrupt  []string
+		problems []string
+	}{
+		"intact": {
+			mutate: func(files map[string][]byte) {},
+		},
+		"missing blob": {
+			mutate: func(files map[string][]byte) {
+				delete(files, layer)
+			},
+			problems: []string{"missing blob " + digest.FromBytes(image.layer).String()},
+		},
+		"corrupt blob": {
+			mutate: func(files map[string][]byte) {
+				files[config] = []byte(`{"os":"linux","architecture":"arm64"}`)
+			},
+			corrupt:  []string{config},
+			problems: []string{"corrupt blob " + digest.FromBytes(image.config).String()},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := storage.ImagePath("app:1")
+			files := image.blobs(blobs)
+			files[path.Join(dir, storage.ReferenceFile)] = []byte("app:1")
+			files[path.Join(dir, "manifest.json")] = image.manifest
+			tt.mutate(files)
+			source := writeBundle(t, files)
+
+			scanner, images := scanBundle(t, source, true)
+			var corrupt []string
+			for fpath := range scanner.corrupt {
+				corrupt = append(corrupt, fpath)
+			}
+			assert.Equal(t, tt.corrupt, corrupt)
+			assert.Equal(t, []imageCheck{{name: "app:1", problems: tt.problems}}, scanner.check(images))
+		})
+	}
+}
+
+func TestCheckIndex(t *testing.T) {
+	files := hashedBundle(t)
+	index, err := json.Marshal(storage.Index{
+		Version: storage.IndexVersion,
+		Images: []storage.IndexImage{
+			{Reference: "app:1", Digest: digest.FromString("other")},
+			{Reference: "gone:1", Digest: digest.FromString("gone")},
+		},
+	})
+	assert.NoError(t, err)
+	files[storage.IndexPath] = index
+	source := writeBundle(t, files)
+
+	scanner, images := scanBundle(t, source, true)
+	dgst := digest.FromBytes(files[path.Join(storage.ImagePath("app:1"), "manifest.json")])
+	assert.Equal(t, []imageCheck{
+		{name: "app:1", problems: []string{"manifest digest mismatch " + dgst.String()}},
+		{name: "gone:1", problems: []string{"missing image"}},
+	}, scanner.check(images))
+}
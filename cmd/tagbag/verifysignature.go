@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	_ "embed"
+	"fmt"
+	"os"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/urfave/cli/v2"
+
+	"github.com/ricardomaraschini/tagbag/signing"
+	"github.com/ricardomaraschini/tagbag/storage"
+	"github.com/ricardomaraschini/tagbag/tgz"
+)
+
+//go:embed static/verify-signature-usage.txt
+var verifySignatureUsageText string
+
+var verifySignatureCommand = &cli.Command{
+	Name:      "verify-signature",
+	Usage:     "Verifies a tarball has been signed with a key",
+	UsageText: verifySignatureUsageText,
+	Flags: []cli.Flag{
+		&cli.StringFlag{
+			Name:     "source",
+			Required: true,
+			Aliases:  []string{"s"},
+			Usage:    "Source tarball path",
+		},
+		&cli.StringSliceFlag{
+			Name:    "overlay",
+			Aliases: []string{"o"},
+			Usage:   "Overlay tarball paths",
+		},
+		&cli.StringFlag{
+			Name:     "key",
+			Required: true,
+			Aliases:  []string{"k"},
+			Usage:    "Public key (ed25519 or ECDSA, PEM encoded) to verify with",
+		},
+		&cli.StringSliceFlag{
+			Name:  "decrypt-key",
+			Usage: "File with the age identities to decrypt encrypted tarballs with",
+		},
+		&cli.StringFlag{
+			Name:  "passphrase-file",
+			Usage: "File with the passphrase to decrypt encrypted tarballs with",
+		},
+	},
+	Action: func(c *cli.Context) error {
+		key, err := signing.LoadPublicKey(c.String("key"))
+		if err != nil {
+			return err
+		}
+		opts, err := decryptionOptions(c)
+		if err != nil {
+			return err
+		}
+		sources := append([]string{c.String("source")}, c.StringSlice("overlay")...)
+		if _, err := verifyBundleSignatures(key, opts, sources); err != nil {
+			return err
+		}
+		fmt.Println("Signature verified")
+		return nil
+	},
+}
+
+// verifyBundleSignatures verifies that the index of each tarball has been
+// signed with the provided key and that the tarballs content matches the
+// signed indexes: every image must be listed, with the same digest, in a
+// signed index and all blobs referred by the images must be present and
+// intact. Signatures are read from the tarballs or, if not embedded, from
+// the detached signature file next to them. Tarballs are read with opts.
+// Returns what has been verified so the content later extracted from the
+// tarballs can be checked against it.
+func verifyBundleSignatures(key crypto.PublicKey, opts []tgz.Option, sources []string) (*signedBundle, error) {
+	scanner := newBundleScanner()
+	scanner.verify = true
+	scanner.opts = opts
+	signed := map[string]digest.Digest{}
+	for _, source := range sources {
+		fmt.Println("Reading", source)
+		scanner.rawIndex, scanner.signature = nil, nil
+		if err := scanner.scan(source); err != nil {
+			return nil, fmt.Errorf("failed to read tarball: %w", err)
+		}
+		if scanner.rawIndex == nil {
+			return nil, fmt.Errorf("%s has no index and can't be verified", source)
+		}
+		signature := scanner.signature
+		if signature == nil {
+			data, err := os.ReadFile(source + signatureSuffix)
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil, fmt.Errorf("%s is not signed", source)
+				}
+				return nil, fmt.Errorf("failed to read signature: %w", err)
+			}
+			signature = data
+		}
+		if err := signing.Verify(key, scanner.rawIndex, signature); err != nil {
+			return nil, fmt.Errorf("failed to verify %s signature: %w", source, err)
+		}
+		for _, image := range scanner.index.Images {
+			signed[image.Reference] = image.Digest
+		}
+	}
+
+	images, err := scanner.images()
+	if err != nil {
+		return nil, fmt.Errorf("failed to process images: %w", err)
+	}
+	corrupt := map[digest.Digest]bool{}
+	for _, dgst := range scanner.corrupt {
+		corrupt[dgst] = true
+	}
+	var problems []string
+	for _, image := range images {
+		dgst, ok := signed[image.Name]
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: not signed", image.Name))
+			continue
+		}
+		if dgst != image.Digest {
+			problems = append(problems, fmt.Sprintf("%s: manifest digest mismatch %s", image.Name, image.Digest))
+		}
+		for _, dgst := range image.missing {
+			problems = append(problems, fmt.Sprintf("%s: missing manifest %s", image.Name, dgst))
+		}
+		for _, dgst := range image.blobs {
+			if corrupt[dgst] {
+				problems = append(problems, fmt.Sprintf("%s: corrupt blob %s", image.Name, dgst))
+			} else if _, ok := scanner.blobs[dgst]; !ok {
+				problems = append(problems, fmt.Sprintf("%s: missing blob %s", image.Name, dgst))
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return &signedBundle{digests: signed, index: scanner.index}, nil
+	}
+	for _, problem := range problems {
+		fmt.Println("  ", problem)
+	}
+	return nil, fmt.Errorf("tarball content does not match the signed index")
+}
+
+// signedBundle holds what verifyBundleSignatures verified: the digest of
+// each image listed in the signed indexes and the last signed index, the
+// one left in place once all tarballs are extracted in order.
+type signedBundle struct {
+	digests map[string]digest.Digest
+	index   *storage.Index
+}
+
+// check makes sure the images extracted into store are the ones verified:
+// each image must be listed in a signed index with the digest of its stored
+// manifest. Metadata is extracted from the tarballs after, and apart from,
+// the verification so the extracted index is replaced by the signed one.
+func (s *signedBundle) check(ctx context.Context, store *storage.Storage) error {
+	if err := store.WriteIndex(s.index); err != nil {
+		return err
+	}
+	images, err := store.Images()
+	if err != nil {
+		return fmt.Errorf("failed to list images: %w", err)
+	}
+	for _, image := range images {
+		expected, ok := s.digests[image]
+		if !ok {
+			return fmt.Errorf("%s is not listed in the signed index", image)
+		}
+		dgst, err := store.ManifestDigest(ctx, image)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", image, err)
+		}
+		if dgst != expected {
+			return fmt.Errorf("%s manifest digest %s does not match the signed index", image, dgst)
+		}
+	}
+	return nil
+}
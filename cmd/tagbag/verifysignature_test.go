@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ricardomaraschini/tagbag/storage"
+)
+
+func TestSignedBundleCheck(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	raw := newTestImage(t, "linux", "amd64").manifest
+	index := &storage.Index{
+		Images: []storage.IndexImage{{Reference: "app:1", Digest: digest.FromBytes(raw)}},
+	}
+	for _, tt := range []struct {
+		name    string
+		digests map[string]digest.Digest
+		err     string
+	}{
+		{
+			name:    "signed",
+			digests: map[string]digest.Digest{"app:1": digest.FromBytes(raw)},
+		},
+		{
+			name:    "manifest replaced",
+			digests: map[string]digest.Digest{"app:1": digest.FromString("other")},
+			err:     "app:1 manifest digest " + digest.FromBytes(raw).String() + " does not match",
+		},
+		{
+			name:    "image added",
+			digests: map[string]digest.Digest{"app:2": digest.FromBytes(raw)},
+			err:     "app:1 is not listed in the signed index",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpdir, err := os.MkdirTemp("", "")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmpdir)
+			store := storage.New(tmpdir)
+			stored, err := store.Reference("app:1")
+			assert.NoError(t, err)
+			dst, err := stored.NewImageDestination(ctx, nil)
+			assert.NoError(t, err)
+			assert.NoError(t, dst.PutManifest(ctx, raw, nil))
+			assert.NoError(t, dst.Commit(ctx, nil))
+			// the extracted index is not the verified one.
+			err = store.WriteIndex(&storage.Index{
+				Images: []storage.IndexImage{{Reference: "app:1", Subject: "app:2"}},
+			})
+			assert.NoError(t, err)
+
+			signed := &signedBundle{digests: tt.digests, index: index}
+			err = signed.check(ctx, store)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			current, err := store.ReadIndex()
+			assert.NoError(t, err)
+			assert.Equal(t, index.Images, current.Images)
+		})
+	}
+}
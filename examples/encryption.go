@@ -0,0 +1,34 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	enchelpers "github.com/containers/ocicrypt/helpers"
+
+	"github.com/ricardomaraschini/tagbag/incremental"
+)
+
+func pushEncrypted() {
+	// Build an ocicrypt configuration encrypting layers to a JWE public key,
+	// the same key formats accepted by podman and skopeo can be used here.
+	config, err := enchelpers.CreateCryptoConfig([]string{"jwe:pubkey.pem"}, []string{})
+	if err != nil {
+		panic(err)
+	}
+	// Create a new incremental pusher encrypting all layers. Layers must be
+	// read in order to be encrypted, layers not carried by difference.tar
+	// can't be reused from the destination registry and the push fails.
+	inc := incremental.New(
+		incremental.WithReporterWriter(os.Stdout),
+		incremental.WithPushAuth("user", "pass"),
+		incremental.WithEncryptConfig(config.EncryptConfig),
+	)
+	if err := inc.Push(
+		context.Background(),
+		"difference.tar",
+		"myaccount/app:v3.0.0",
+	); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/ricardomaraschini/tagbag/incremental"
+	"github.com/ricardomaraschini/tagbag/platform"
+)
+
+func pullPlatforms() {
+	// Create a new incremental puller that computes the difference for the
+	// arm64 and amd64 instances only, regardless of the platform we are
+	// running on. Use incremental.WithSystemContextOverrides to pick a single
+	// platform instead.
+	inc := incremental.New(
+		incremental.WithReporterWriter(os.Stdout),
+		incremental.WithPlatforms(
+			platform.Platform{OS: "linux", Architecture: "arm64"},
+			platform.Platform{OS: "linux", Architecture: "amd64"},
+		),
+	)
+	diff, err := inc.Pull(
+		context.Background(),
+		"myaccount/myapp:v1.0.0",
+		"myaccount/myapp:v2.0.0",
+	)
+	if err != nil {
+		panic(err)
+	}
+	defer diff.Close()
+	fp, err := os.Create("difference.tar")
+	if err != nil {
+		panic(err)
+	}
+	defer fp.Close()
+	if _, err := io.Copy(fp, diff); err != nil {
+		panic(err)
+	}
+}
@@ -6,12 +6,17 @@ import (
 	"io"
 	"os"
 	"path"
+	"runtime"
 
+	encconfig "github.com/containers/ocicrypt/config"
 	"github.com/google/uuid"
 	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/signature"
 	"go.podman.io/image/v5/transports/alltransports"
 	"go.podman.io/image/v5/types"
 
+	"github.com/ricardomaraschini/tagbag/platform"
 	"github.com/ricardomaraschini/tagbag/policy"
 )
 
@@ -40,6 +45,96 @@ type Incremental struct {
 	report    io.Writer
 	auths     Authentications
 	selection copy.ImageListSelection
+	platforms []platform.Platform
+	overrides platform.Platform
+	polctx    *signature.PolicyContext
+	encrypt   *encconfig.EncryptConfig
+	decrypt   *encconfig.DecryptConfig
+}
+
+// policyContext returns the policy context images are copied with and a
+// function to be called once the copy is done. The policy context provided
+// through WithPolicyContext is owned by the caller and is not destroyed.
+func (inc *Incremental) policyContext() (*signature.PolicyContext, func(), error) {
+	if inc.polctx != nil {
+		return inc.polctx, func() {}, nil
+	}
+	polctx, err := policy.Context()
+	if err != nil {
+		return nil, nil, err
+	}
+	return polctx, func() { polctx.Destroy() }, nil
+}
+
+// sysctx returns a system context using the provided authentication and the
+// configured platform overrides.
+func (inc *Incremental) sysctx(auth *types.DockerAuthConfig) *types.SystemContext {
+	return &types.SystemContext{
+		DockerAuthConfig:   auth,
+		OSChoice:           inc.overrides.OS,
+		ArchitectureChoice: inc.overrides.Architecture,
+		VariantChoice:      inc.overrides.Variant,
+	}
+}
+
+// matching returns the platforms whose instances are copied. Returns nil if
+// instances are not filtered by platform.
+func (inc *Incremental) matching() []platform.Platform {
+	if len(inc.platforms) > 0 {
+		return inc.platforms
+	}
+	if inc.selection == copy.CopyAllImages || inc.overrides == (platform.Platform{}) {
+		return nil
+	}
+	native := platform.Platform{
+		OS:           runtime.GOOS,
+		Architecture: runtime.GOARCH,
+		Variant:      inc.overrides.Variant,
+	}
+	if inc.overrides.OS != "" {
+		native.OS = inc.overrides.OS
+	}
+	if inc.overrides.Architecture != "" {
+		native.Architecture = inc.overrides.Architecture
+	}
+	return []platform.Platform{native}
+}
+
+// copyOptions returns the options for copying the image referred by src. If
+// platforms were provided only the matching instances are copied and the
+// manifest list is trimmed accordingly.
+func (inc *Incremental) copyOptions(
+	ctx context.Context, src types.ImageReference, srcctx, dstctx *types.SystemContext,
+) (*copy.Options, error) {
+	opts := &copy.Options{
+		ReportWriter:       inc.report,
+		SourceCtx:          srcctx,
+		DestinationCtx:     dstctx,
+		ImageListSelection: inc.selection,
+	}
+	if len(inc.platforms) == 0 {
+		return opts, nil
+	}
+	srcimage, err := src.NewImageSource(ctx, srcctx)
+	if err != nil {
+		return nil, fmt.Errorf("error creating source image: %w", err)
+	}
+	defer srcimage.Close()
+	raw, mime, err := srcimage.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error getting manifest: %w", err)
+	}
+	if !manifest.MIMETypeIsMultiImage(mime) {
+		return opts, nil
+	}
+	instances, err := platform.MatchInstances(raw, inc.platforms)
+	if err != nil {
+		return nil, fmt.Errorf("error selecting manifests: %w", err)
+	}
+	opts.ImageListSelection = copy.CopySpecificImages
+	opts.Instances = instances
+	opts.SparseManifestListAction = copy.StripSparseManifestList
+	return opts, nil
 }
 
 // PushVet verifies if all the layers not included in the incremental difference exist
@@ -50,8 +145,8 @@ func (inc *Incremental) PushVet(ctx context.Context, src, dst string) error {
 	if err != nil {
 		return fmt.Errorf("error parsing destination reference: %w", err)
 	}
-	sysctx := &types.SystemContext{DockerAuthConfig: inc.auths.PushAuth}
-	mans, err := FetchManifests(ctx, dstref, sysctx)
+	sysctx := inc.sysctx(inc.auths.PushAuth)
+	mans, err := FetchManifests(ctx, dstref, sysctx, inc.matching()...)
 	if err != nil {
 		return fmt.Errorf("error fetching destination manifests: %w", err)
 	}
@@ -65,7 +160,7 @@ func (inc *Incremental) PushVet(ctx context.Context, src, dst string) error {
 		return fmt.Errorf("error creating source image: %w", err)
 	}
 	defer srcimage.Close()
-	srcmans, err := FetchManifests(ctx, srcref, &types.SystemContext{})
+	srcmans, err := FetchManifests(ctx, srcref, inc.sysctx(nil), inc.matching()...)
 	if err != nil {
 		return fmt.Errorf("error fetching source manifests: %w", err)
 	}
@@ -100,24 +195,21 @@ func (inc *Incremental) Push(ctx context.Context, src, dst string) error {
 	if err != nil {
 		return fmt.Errorf("error parsing source reference: %w", err)
 	}
-	polctx, err := policy.Context()
+	opts, err := inc.copyOptions(ctx, srcref, inc.sysctx(nil), inc.sysctx(inc.auths.PushAuth))
+	if err != nil {
+		return err
+	}
+	if inc.encrypt != nil {
+		// an empty list of layers means all layers.
+		opts.OciEncryptConfig = inc.encrypt
+		opts.OciEncryptLayers = &[]int{}
+	}
+	polctx, release, err := inc.policyContext()
 	if err != nil {
 		return fmt.Errorf("error creating policy context: %w", err)
 	}
-	if _, err := copy.Image(
-		ctx,
-		polctx,
-		dstref,
-		srcref,
-		&copy.Options{
-			ReportWriter:       inc.report,
-			SourceCtx:          &types.SystemContext{},
-			ImageListSelection: inc.selection,
-			DestinationCtx: &types.SystemContext{
-				DockerAuthConfig: inc.auths.PushAuth,
-			},
-		},
-	); err != nil {
+	defer release()
+	if _, err := copy.Image(ctx, polctx, dstref, srcref, opts); err != nil {
 		return fmt.Errorf("failed copying layers: %w", err)
 	}
 	return nil
@@ -143,29 +235,22 @@ func (inc *Incremental) Pull(ctx context.Context, base, final string) (io.ReadCl
 	if err != nil {
 		return nil, fmt.Errorf("error parsing destination reference: %w", err)
 	}
-	sysctx := &types.SystemContext{DockerAuthConfig: inc.auths.BaseAuth}
-	destref, err := NewWriter(ctx, baseref, dstref, sysctx)
+	sysctx := inc.sysctx(inc.auths.BaseAuth)
+	destref, err := NewWriter(ctx, baseref, dstref, sysctx, inc.matching()...)
 	if err != nil {
 		return nil, fmt.Errorf("error creating incremental writer: %w", err)
 	}
-	polctx, err := policy.Context()
+	opts, err := inc.copyOptions(ctx, finalref, inc.sysctx(inc.auths.FinalAuth), inc.sysctx(nil))
+	if err != nil {
+		return nil, err
+	}
+	opts.OciDecryptConfig = inc.decrypt
+	polctx, release, err := inc.policyContext()
 	if err != nil {
 		return nil, fmt.Errorf("error creating policy context: %w", err)
 	}
-	if _, err := copy.Image(
-		ctx,
-		polctx,
-		destref,
-		finalref,
-		&copy.Options{
-			ReportWriter:       inc.report,
-			DestinationCtx:     &types.SystemContext{},
-			ImageListSelection: inc.selection,
-			SourceCtx: &types.SystemContext{
-				DockerAuthConfig: inc.auths.FinalAuth,
-			},
-		},
-	); err != nil {
+	defer release()
+	if _, err := copy.Image(ctx, polctx, destref, finalref, opts); err != nil {
 		return nil, fmt.Errorf("failed copying layers: %w", err)
 	}
 	fp, err := os.Open(tpath)
@@ -7,6 +7,8 @@ import (
 	"github.com/opencontainers/go-digest"
 	"go.podman.io/image/v5/manifest"
 	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/platform"
 )
 
 // ProcessList expects raw to point to a manifest list and will iterate over
@@ -16,8 +18,13 @@ func ProcessList(ctx context.Context, fromref types.ImageSource, raw []byte, mim
 	if err != nil {
 		return nil, fmt.Errorf("error parsing manifests: %w", err)
 	}
+	return fetchInstances(ctx, fromref, list.Instances())
+}
+
+// fetchInstances fetches and parses the manifests of the provided instances.
+func fetchInstances(ctx context.Context, fromref types.ImageSource, instances []digest.Digest) ([]manifest.Manifest, error) {
 	children := []manifest.Manifest{}
-	for _, digest := range list.Instances() {
+	for _, digest := range instances {
 		raw, mime, err := fromref.GetManifest(ctx, &digest)
 		if err != nil {
 			return nil, fmt.Errorf("error getting child manifest: %w", err)
@@ -33,8 +40,9 @@ func ProcessList(ctx context.Context, fromref types.ImageSource, raw []byte, mim
 
 // fetchManifests returns the list of manifests that are present in the
 // source image. In case of a manifest list it will iterate over the
-// children and return them.
-func FetchManifests(ctx context.Context, from types.ImageReference, sysctx *types.SystemContext) ([]manifest.Manifest, error) {
+// children and return them. If platforms are provided only the children
+// matching any of them are returned.
+func FetchManifests(ctx context.Context, from types.ImageReference, sysctx *types.SystemContext, platforms ...platform.Platform) ([]manifest.Manifest, error) {
 	fromref, err := from.NewImageSource(ctx, sysctx)
 	if err != nil {
 		return nil, fmt.Errorf("error creating image source: %w", err)
@@ -45,7 +53,14 @@ func FetchManifests(ctx context.Context, from types.ImageReference, sysctx *type
 		return nil, fmt.Errorf("error getting manifest: %w", err)
 	}
 	if manifest.MIMETypeIsMultiImage(mime) {
-		return ProcessList(ctx, fromref, raw, mime)
+		if len(platforms) == 0 {
+			return ProcessList(ctx, fromref, raw, mime)
+		}
+		instances, err := platform.MatchInstances(raw, platforms)
+		if err != nil {
+			return nil, fmt.Errorf("error selecting manifests: %w", err)
+		}
+		return fetchInstances(ctx, fromref, instances)
 	}
 	man, err := manifest.FromBlob(raw, mime)
 	if err != nil {
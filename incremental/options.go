@@ -3,8 +3,12 @@ package incremental
 import (
 	"io"
 
+	encconfig "github.com/containers/ocicrypt/config"
 	"go.podman.io/image/v5/copy"
+	"go.podman.io/image/v5/signature"
 	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/platform"
 )
 
 // Option is a functional option for the Incremental type.
@@ -68,3 +72,58 @@ func WithAllArchitectures() Option {
 		inc.selection = copy.CopyAllImages
 	}
 }
+
+// WithPlatforms restricts the images to the instances, of manifest lists,
+// matching any of the provided platforms. The base layers dictionary is
+// computed from the matching instances only. Takes precedence over
+// WithAllArchitectures.
+func WithPlatforms(platforms ...platform.Platform) Option {
+	return func(inc *Incremental) {
+		inc.platforms = platforms
+	}
+}
+
+// WithSystemContextOverrides overrides the operating system, architecture and
+// variant used when choosing the instance of manifest lists, by default these
+// are the ones of the running system. Empty values are not overridden.
+func WithSystemContextOverrides(os, arch, variant string) Option {
+	return func(inc *Incremental) {
+		inc.overrides = platform.Platform{
+			OS:           os,
+			Architecture: arch,
+			Variant:      variant,
+		}
+	}
+}
+
+// WithPolicyContext sets the policy context used to verify the images being
+// copied, see policy.FromFile. By default any image is accepted. Policy
+// contexts are not safe for concurrent use, Incremental objects created with
+// this option must not be used concurrently. The caller is responsible for
+// destroying the policy context.
+func WithPolicyContext(polctx *signature.PolicyContext) Option {
+	return func(inc *Incremental) {
+		inc.polctx = polctx
+	}
+}
+
+// WithEncryptConfig makes Push encrypt all layers, with ocicrypt, using the
+// provided configuration (see helpers.CreateCryptoConfig in ocicrypt). As
+// layers must be read to be encrypted the incremental difference must carry
+// all of them, layers expected to exist in the destination can't be reused.
+func WithEncryptConfig(config *encconfig.EncryptConfig) Option {
+	return func(inc *Incremental) {
+		inc.encrypt = config
+	}
+}
+
+// WithDecryptConfig makes Pull decrypt the layers of the final image, if
+// encrypted with ocicrypt, using the provided configuration (see
+// helpers.CreateCryptoConfig in ocicrypt). Decrypted layers have different
+// digests than the encrypted ones, layers are only excluded from the
+// difference if the base image carries them decrypted as well.
+func WithDecryptConfig(config *encconfig.DecryptConfig) Option {
+	return func(inc *Incremental) {
+		inc.decrypt = config
+	}
+}
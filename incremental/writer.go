@@ -6,6 +6,8 @@ import (
 
 	"github.com/opencontainers/go-digest"
 	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/platform"
 )
 
 // Writer provides a tool to copy only the layers that are not already
@@ -40,13 +42,15 @@ func (d *destwrap) TryReusingBlob(ctx context.Context, info types.BlobInfo, cach
 }
 
 // NewWriter is capable of providing an incremental copy of an image using
-// 'from' as base and storing the result in 'to'.
-func NewWriter(ctx context.Context, from types.ImageReference, to types.ImageReference, sysctx *types.SystemContext) (*Writer, error) {
+// 'from' as base and storing the result in 'to'. If platforms are provided
+// only the layers of the 'from' instances matching them are considered as
+// already present.
+func NewWriter(ctx context.Context, from types.ImageReference, to types.ImageReference, sysctx *types.SystemContext, platforms ...platform.Platform) (*Writer, error) {
 	toref, err := to.NewImageDestination(ctx, sysctx)
 	if err != nil {
 		return nil, fmt.Errorf("error creating destination: %w", err)
 	}
-	mans, err := FetchManifests(ctx, from, sysctx)
+	mans, err := FetchManifests(ctx, from, sysctx, platforms...)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching manifests: %w", err)
 	}
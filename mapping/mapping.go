@@ -0,0 +1,91 @@
+package mapping
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Rule rewrites image names. A rule matches either by prefix or by regular
+// expression, exactly one of Prefix or Regex must be set. Prefix rules
+// replace the matched prefix by Replace while regex rules replace all the
+// matches by Replace, which may refer to submatches ($1, ${name}, etc).
+type Rule struct {
+	Prefix  string `yaml:"prefix,omitempty" json:"prefix,omitempty"`
+	Regex   string `yaml:"regex,omitempty" json:"regex,omitempty"`
+	Replace string `yaml:"replace" json:"replace"`
+	regex   *regexp.Regexp
+}
+
+// apply applies the rule to name. Returns the rewritten name and true if
+// the rule matched.
+func (r *Rule) apply(name string) (string, bool) {
+	if r.regex != nil {
+		if !r.regex.MatchString(name) {
+			return name, false
+		}
+		return r.regex.ReplaceAllString(name, r.Replace), true
+	}
+	if !strings.HasPrefix(name, r.Prefix) {
+		return name, false
+	}
+	return r.Replace + strings.TrimPrefix(name, r.Prefix), true
+}
+
+// Mapping is a list of rules used to compute the destination reference of
+// images. Rules are applied in order, each one to the output of the
+// previous one, so a rule can move an image to another registry and a later
+// one can change its tag.
+type Mapping struct {
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+// Apply applies all rules to the provided image name. Returns the rewritten
+// name and true if any rule matched. A nil Mapping matches nothing.
+func (m *Mapping) Apply(name string) (string, bool) {
+	if m == nil {
+		return name, false
+	}
+	var matched bool
+	for i := range m.Rules {
+		var ok bool
+		name, ok = m.Rules[i].apply(name)
+		matched = matched || ok
+	}
+	return name, matched
+}
+
+// Parse parses a Mapping in YAML or JSON format.
+func Parse(data []byte) (*Mapping, error) {
+	var mapping Mapping
+	if err := yaml.Unmarshal(data, &mapping); err != nil {
+		return nil, fmt.Errorf("failed to decode mapping: %w", err)
+	}
+	for i := range mapping.Rules {
+		rule := &mapping.Rules[i]
+		if (rule.Prefix == "") == (rule.Regex == "") {
+			return nil, fmt.Errorf("rule %d: exactly one of prefix or regex must be set", i)
+		}
+		if rule.Regex == "" {
+			continue
+		}
+		regex, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: invalid regex: %w", i, err)
+		}
+		rule.regex = regex
+	}
+	return &mapping, nil
+}
+
+// Load reads and parses a Mapping from the provided file.
+func Load(fpath string) (*Mapping, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mapping: %w", err)
+	}
+	return Parse(data)
+}
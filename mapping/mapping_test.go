@@ -0,0 +1,75 @@
+package mapping
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApply(t *testing.T) {
+	mapping, err := Parse([]byte(`
+rules:
+  - prefix: registry.k8s.io/
+    replace: mirror.corp/k8s/
+  - regex: ^(.+):latest$
+    replace: ${1}:v1.0.0
+`))
+	assert.NoError(t, err)
+	for _, tt := range []struct {
+		name    string
+		dest    string
+		matched bool
+	}{
+		{name: "registry.k8s.io/pause:3.9", dest: "mirror.corp/k8s/pause:3.9", matched: true},
+		{name: "registry.k8s.io/pause:latest", dest: "mirror.corp/k8s/pause:v1.0.0", matched: true},
+		{name: "quay.io/app:latest", dest: "quay.io/app:v1.0.0", matched: true},
+		{name: "quay.io/app:1", dest: "quay.io/app:1", matched: false},
+	} {
+		dest, matched := mapping.Apply(tt.name)
+		assert.Equal(t, tt.dest, dest)
+		assert.Equal(t, tt.matched, matched)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	mapping, err := Parse([]byte(`{"rules": [{"prefix": "a/", "replace": "b/"}]}`))
+	assert.NoError(t, err)
+	dest, matched := mapping.Apply("a/app:1")
+	assert.True(t, matched)
+	assert.Equal(t, "b/app:1", dest)
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, data := range []string{
+		`rules: [{replace: b}]`,
+		`rules: [{prefix: a, regex: a, replace: b}]`,
+		`rules: [{regex: "(", replace: b}]`,
+		`rules: {}`,
+	} {
+		_, err := Parse([]byte(data))
+		assert.Error(t, err, data)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	fpath := path.Join(tmpdir, "mapping.yaml")
+	err = os.WriteFile(fpath, []byte("rules: [{prefix: a/, replace: b/}]"), 0600)
+	assert.NoError(t, err)
+	mapping, err := Load(fpath)
+	assert.NoError(t, err)
+	assert.Len(t, mapping.Rules, 1)
+	_, err = Load(path.Join(tmpdir, "missing.yaml"))
+	assert.Error(t, err)
+}
+
+func TestApplyNil(t *testing.T) {
+	var mapping *Mapping
+	dest, matched := mapping.Apply("quay.io/app:1")
+	assert.False(t, matched)
+	assert.Equal(t, "quay.io/app:1", dest)
+}
@@ -0,0 +1,78 @@
+package platform
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// Platform identifies the platform an image was built for.
+type Platform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// String returns the platform in the os/arch[/variant] format.
+func (p Platform) String() string {
+	parts := []string{p.OS, p.Architecture}
+	if p.Variant != "" {
+		parts = append(parts, p.Variant)
+	}
+	return strings.Join(parts, "/")
+}
+
+// Parse parses a platform in the os/arch[/variant] format.
+func Parse(value string) (Platform, error) {
+	parts := strings.Split(value, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q, expected os/arch[/variant]", value)
+	}
+	platform := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// Matches returns true if the provided platform matches this one. A
+// platform without variant matches all variants.
+func (p Platform) Matches(other Platform) bool {
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+	return p.Variant == "" || p.Variant == other.Variant
+}
+
+// MatchInstances returns the digests of the instances of the manifest list
+// raw that match any of the provided platforms. Instances without platform
+// are never matched. Returns an error if no instance matches.
+func MatchInstances(raw []byte, platforms []Platform) ([]digest.Digest, error) {
+	var list struct {
+		Manifests []struct {
+			Digest   digest.Digest `json:"digest"`
+			Platform *Platform     `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("failed to parse manifest list: %w", err)
+	}
+	var instances []digest.Digest
+	for _, instance := range list.Manifests {
+		if instance.Platform == nil {
+			continue
+		}
+		for _, platform := range platforms {
+			if platform.Matches(*instance.Platform) {
+				instances = append(instances, instance.Digest)
+				break
+			}
+		}
+	}
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no instance matches the requested platforms")
+	}
+	return instances, nil
+}
@@ -0,0 +1,51 @@
+package platform
+
+import (
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParse(t *testing.T) {
+	platform, err := Parse("linux/arm64/v8")
+	assert.NoError(t, err)
+	assert.Equal(t, Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}, platform)
+	assert.Equal(t, "linux/arm64/v8", platform.String())
+	platform, err = Parse("linux/amd64")
+	assert.NoError(t, err)
+	assert.Equal(t, Platform{OS: "linux", Architecture: "amd64"}, platform)
+	for _, invalid := range []string{"", "linux", "linux/", "/amd64", "linux/arm64/v8/x"} {
+		_, err := Parse(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestMatches(t *testing.T) {
+	arm64 := Platform{OS: "linux", Architecture: "arm64"}
+	arm64v8 := Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	assert.True(t, arm64.Matches(arm64v8))
+	assert.True(t, arm64v8.Matches(arm64v8))
+	assert.False(t, arm64v8.Matches(arm64))
+	assert.False(t, arm64.Matches(Platform{OS: "linux", Architecture: "amd64"}))
+	assert.False(t, arm64.Matches(Platform{OS: "windows", Architecture: "arm64"}))
+}
+
+func TestMatchInstances(t *testing.T) {
+	raw := []byte(`{"manifests": [
+		{"digest": "sha256:aa", "platform": {"os": "linux", "architecture": "amd64"}},
+		{"digest": "sha256:bb", "platform": {"os": "linux", "architecture": "arm64", "variant": "v8"}},
+		{"digest": "sha256:cc", "platform": {"os": "linux", "architecture": "s390x"}},
+		{"digest": "sha256:dd"}
+	]}`)
+
+	instances, err := MatchInstances(raw, []Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []digest.Digest{"sha256:aa", "sha256:bb"}, instances)
+
+	_, err = MatchInstances(raw, []Platform{{OS: "linux", Architecture: "ppc64le"}})
+	assert.Error(t, err)
+}
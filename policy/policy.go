@@ -1,6 +1,8 @@
 package policy
 
 import (
+	"fmt"
+
 	"go.podman.io/image/v5/signature"
 )
 
@@ -22,3 +24,28 @@ func MustContext() *signature.PolicyContext {
 	}
 	return context
 }
+
+// FromFile returns a policy context enforcing the policy stored in the
+// provided file. The file uses the containers-policy.json(5) format, the
+// same used by podman and skopeo, allowing to require sigstore or GPG
+// signatures per registry or repository.
+func FromFile(fpath string) (*signature.PolicyContext, error) {
+	pol, err := signature.NewPolicyFromFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read policy %s: %w", fpath, err)
+	}
+	context, err := signature.NewPolicyContext(pol)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create policy context: %w", err)
+	}
+	return context, nil
+}
+
+// ContextFor returns the policy context for the policy stored in the
+// provided file or the default policy context if fpath is empty.
+func ContextFor(fpath string) (*signature.PolicyContext, error) {
+	if fpath == "" {
+		return Context()
+	}
+	return FromFile(fpath)
+}
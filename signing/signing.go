@@ -0,0 +1,141 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrInvalidSignature is returned when a signature does not match the signed
+// payload or the key.
+var ErrInvalidSignature = errors.New("invalid signature")
+
+// ParsePrivateKey parses an unencrypted ed25519 or ECDSA private key in the
+// PEM format, either PKCS#8 ("PRIVATE KEY") or SEC 1 ("EC PRIVATE KEY").
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode pem block")
+	}
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		switch key := key.(type) {
+		case ed25519.PrivateKey:
+			return key, nil
+		case *ecdsa.PrivateKey:
+			return key, nil
+		default:
+			return nil, fmt.Errorf("unsupported private key type %T", key)
+		}
+	case "EC PRIVATE KEY":
+		key, err := x509.ParseECPrivateKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported pem block %q", block.Type)
+	}
+}
+
+// ParsePublicKey parses an ed25519 or ECDSA public key in the PEM PKIX
+// format ("PUBLIC KEY"), as written by cosign or openssl.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("failed to decode pem block")
+	}
+	if block.Type != "PUBLIC KEY" {
+		return nil, fmt.Errorf("unsupported pem block %q", block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key: %w", err)
+	}
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		return key, nil
+	case *ecdsa.PublicKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", key)
+	}
+}
+
+// LoadPrivateKey reads the private key stored in the provided file. See
+// ParsePrivateKey for the supported formats.
+func LoadPrivateKey(fpath string) (crypto.Signer, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read private key: %w", err)
+	}
+	return ParsePrivateKey(data)
+}
+
+// LoadPublicKey reads the public key stored in the provided file. See
+// ParsePublicKey for the supported formats.
+func LoadPublicKey(fpath string) (crypto.PublicKey, error) {
+	data, err := os.ReadFile(fpath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read public key: %w", err)
+	}
+	return ParsePublicKey(data)
+}
+
+// Sign signs the payload with the provided key and returns the signature
+// base64 encoded. ECDSA keys sign the sha256 digest of the payload, ed25519
+// keys sign the payload itself. This is the format used by cosign sign-blob
+// so signatures can also be verified with cosign verify-blob.
+func Sign(key crypto.Signer, payload []byte) ([]byte, error) {
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case ed25519.PrivateKey:
+		sig = ed25519.Sign(key, payload)
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256(payload)
+		sig, err = ecdsa.SignASN1(rand.Reader, key, sum[:])
+	default:
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign: %w", err)
+	}
+	return []byte(base64.StdEncoding.EncodeToString(sig)), nil
+}
+
+// Verify verifies the base64 encoded signature of the payload against the
+// provided key. Returns ErrInvalidSignature if the signature does not match.
+func Verify(key crypto.PublicKey, payload, signature []byte) error {
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("failed to decode signature: %w", err)
+	}
+	var valid bool
+	switch key := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(key, payload, sig)
+	case *ecdsa.PublicKey:
+		sum := sha256.Sum256(payload)
+		valid = ecdsa.VerifyASN1(key, sum[:], sig)
+	default:
+		return fmt.Errorf("unsupported public key type %T", key)
+	}
+	if !valid {
+		return ErrInvalidSignature
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package signing
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeKeys writes the provided key pair, PEM encoded, into dir. Returns the
+// private and public key paths.
+func writeKeys(t *testing.T, dir string, private crypto.Signer) (string, string) {
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.NoError(t, err)
+	privpath := path.Join(dir, "key.pem")
+	err = os.WriteFile(privpath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	assert.NoError(t, err)
+	der, err = x509.MarshalPKIXPublicKey(private.Public())
+	assert.NoError(t, err)
+	pubpath := path.Join(dir, "key.pub")
+	err = os.WriteFile(pubpath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0600)
+	assert.NoError(t, err)
+	return privpath, pubpath
+}
+
+func TestSignVerify(t *testing.T) {
+	_, edkey, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	eckey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	for name, key := range map[string]crypto.Signer{"ed25519": edkey, "ecdsa": eckey} {
+		t.Run(name, func(t *testing.T) {
+			tmpdir, err := os.MkdirTemp("", "")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmpdir)
+			privpath, pubpath := writeKeys(t, tmpdir, key)
+			private, err := LoadPrivateKey(privpath)
+			assert.NoError(t, err)
+			public, err := LoadPublicKey(pubpath)
+			assert.NoError(t, err)
+
+			sig, err := Sign(private, []byte("payload"))
+			assert.NoError(t, err)
+			err = Verify(public, []byte("payload"), sig)
+			assert.NoError(t, err)
+			err = Verify(public, []byte("tampered"), sig)
+			assert.ErrorIs(t, err, ErrInvalidSignature)
+		})
+	}
+}
+
+func TestVerifyWrongKey(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	other, _, err := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, err)
+	sig, err := Sign(key, []byte("payload"))
+	assert.NoError(t, err)
+	err = Verify(other, []byte("payload"), sig)
+	assert.ErrorIs(t, err, ErrInvalidSignature)
+}
+
+func TestParseInvalidKeys(t *testing.T) {
+	_, err := ParsePrivateKey([]byte("not a key"))
+	assert.Error(t, err)
+	_, err = ParsePublicKey([]byte("not a key"))
+	assert.Error(t, err)
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("x")})
+	_, err = ParsePrivateKey(block)
+	assert.Error(t, err)
+	_, err = ParsePublicKey(block)
+	assert.Error(t, err)
+}
@@ -0,0 +1,291 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/platform"
+)
+
+// IndexVersion is the version of the index format written by this package.
+// Readers must refuse indexes with a version greater than this one.
+const IndexVersion = 1
+
+// IndexPath is the location, relative to the Storage base directory, where
+// the bundle index is kept.
+const IndexPath = ".tagbag/index.json"
+
+// IndexSignaturePath is the location, relative to the Storage base
+// directory, where the signature of the bundle index is embedded.
+const IndexSignaturePath = ".tagbag/index.json.sig"
+
+// ErrNoIndex is returned when the Storage does not contain an index. This
+// is the case for bundles created by older versions of tagbag.
+var ErrNoIndex = errors.New("bundle index not found")
+
+// signatureRegexp matches the names of the signature files written by the
+// directory transport.
+var signatureRegexp = regexp.MustCompile(`^signature-[0-9]+$`)
+
+// Index describes the content of a bundle. It is written at pull time and
+// allows callers to learn about the bundle content without walking the
+// Storage directory tree. Platforms holds the platforms images were
+// filtered by when pulling, it is empty if no filter was used.
+type Index struct {
+	Version       int                 `json:"version"`
+	TagbagVersion string              `json:"tagbagVersion"`
+	Platforms     []platform.Platform `json:"platforms,omitempty"`
+	Images        []IndexImage        `json:"images"`
+}
+
+// IndexImage describes a single image stored in a bundle. Reference is the
+// original image reference as provided by the user when pulling, Path is
+// the directory, relative to the bundle root, where the image is stored
+// (empty for bundles in the OCI image layout format) and Digest is the
+// digest of the top level manifest (this may be a manifest list).
+// Signatures lists the simple signing signature files stored, inside Path,
+// along with the image. Subject is set for signatures, attestations and
+// other artifacts attached to an image, it holds the reference of the
+// image they are attached to.
+type IndexImage struct {
+	Reference  string              `json:"reference"`
+	Path       string              `json:"path,omitempty"`
+	Digest     digest.Digest       `json:"digest"`
+	MediaType  string              `json:"mediaType"`
+	Platforms  []platform.Platform `json:"platforms,omitempty"`
+	Signatures []string            `json:"signatures,omitempty"`
+	Subject    string              `json:"subject,omitempty"`
+	Blobs      []IndexBlob         `json:"blobs"`
+}
+
+// IndexBlob describes a blob (a layer or a config) referred by an image.
+type IndexBlob struct {
+	Digest digest.Digest `json:"digest"`
+	Size   int64         `json:"size"`
+}
+
+// Image returns the image with the provided reference or false if the index
+// does not contain it.
+func (i *Index) Image(ref string) (IndexImage, bool) {
+	for _, img := range i.Images {
+		if img.Reference == ref {
+			return img, true
+		}
+	}
+	return IndexImage{}, false
+}
+
+// ReadIndex reads the index stored in the Storage. Returns ErrNoIndex if
+// the Storage does not contain one.
+func (t *Storage) ReadIndex() (*Index, error) {
+	data, err := os.ReadFile(path.Join(t.basedir, IndexPath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNoIndex
+		}
+		return nil, fmt.Errorf("failed to read index: %w", err)
+	}
+	var index Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("failed to parse index: %w", err)
+	}
+	if index.Version > IndexVersion {
+		return nil, fmt.Errorf("unsupported index version %d", index.Version)
+	}
+	return &index, nil
+}
+
+// WriteIndex writes the provided index into the Storage, replacing any
+// index previously written.
+func (t *Storage) WriteIndex(index *Index) error {
+	index.Version = IndexVersion
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+	fpath := path.Join(t.basedir, IndexPath)
+	if err := os.MkdirAll(path.Dir(fpath), 0700); err != nil {
+		return fmt.Errorf("failed to create index dir: %w", err)
+	}
+	if err := os.WriteFile(fpath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write index: %w", err)
+	}
+	return nil
+}
+
+// Manifest returns the top level manifest of the provided image along with
+// its media type.
+func (t *Storage) Manifest(ctx context.Context, image string) ([]byte, string, error) {
+	src, err := t.imageSource(ctx, image)
+	if err != nil {
+		return nil, "", err
+	}
+	defer src.Close()
+	raw, mime, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read manifest: %w", err)
+	}
+	return raw, mime, nil
+}
+
+// ManifestDigest returns the digest of the top level manifest of the provided
+// image.
+func (t *Storage) ManifestDigest(ctx context.Context, image string) (digest.Digest, error) {
+	raw, _, err := t.Manifest(ctx, image)
+	if err != nil {
+		return "", err
+	}
+	dgst, err := manifest.Digest(raw)
+	if err != nil {
+		return "", fmt.Errorf("failed to digest manifest: %w", err)
+	}
+	return dgst, nil
+}
+
+// Describe reads the manifests of the provided image and returns its index
+// entry. If the image is a manifest list all its instances are described.
+func (t *Storage) Describe(ctx context.Context, image string) (IndexImage, error) {
+	src, err := t.imageSource(ctx, image)
+	if err != nil {
+		return IndexImage{}, err
+	}
+	defer src.Close()
+	raw, mime, err := src.GetManifest(ctx, nil)
+	if err != nil {
+		return IndexImage{}, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	dgst, err := manifest.Digest(raw)
+	if err != nil {
+		return IndexImage{}, fmt.Errorf("failed to digest manifest: %w", err)
+	}
+	result := IndexImage{
+		Reference: image,
+		Path:      t.imageDir(image),
+		Digest:    dgst,
+		MediaType: mime,
+	}
+	if result.Signatures, err = t.signatures(result.Path); err != nil {
+		return IndexImage{}, err
+	}
+	seen := map[digest.Digest]bool{}
+	addblobs := func(blobs []IndexBlob) {
+		for _, blob := range blobs {
+			if seen[blob.Digest] {
+				continue
+			}
+			seen[blob.Digest] = true
+			result.Blobs = append(result.Blobs, blob)
+		}
+	}
+	if !manifest.MIMETypeIsMultiImage(mime) {
+		blobs, described, err := describeManifest(ctx, src, raw, mime)
+		if err != nil {
+			return IndexImage{}, err
+		}
+		addblobs(blobs)
+		if described != nil {
+			result.Platforms = []platform.Platform{*described}
+		}
+		return result, nil
+	}
+	var list struct {
+		Manifests []struct {
+			Digest   digest.Digest      `json:"digest"`
+			Platform *platform.Platform `json:"platform"`
+		} `json:"manifests"`
+	}
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return IndexImage{}, fmt.Errorf("failed to parse manifest list: %w", err)
+	}
+	for _, instance := range list.Manifests {
+		raw, mime, err := src.GetManifest(ctx, &instance.Digest)
+		if err != nil {
+			if os.IsNotExist(err) {
+				// only a subset of the instances has been pulled.
+				continue
+			}
+			return IndexImage{}, fmt.Errorf("failed to read child manifest: %w", err)
+		}
+		blobs, described, err := describeManifest(ctx, src, raw, mime)
+		if err != nil {
+			return IndexImage{}, err
+		}
+		addblobs(blobs)
+		if instance.Platform != nil {
+			described = instance.Platform
+		}
+		if described != nil {
+			result.Platforms = append(result.Platforms, *described)
+		}
+	}
+	return result, nil
+}
+
+// signatures returns the names of the signature files, as written by the
+// directory transport, stored in the provided image directory.
+func (t *Storage) signatures(dir string) ([]string, error) {
+	matches, err := filepath.Glob(path.Join(t.basedir, dir, "signature-*"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list signatures: %w", err)
+	}
+	var names []string
+	for _, match := range matches {
+		if signatureRegexp.MatchString(path.Base(match)) {
+			names = append(names, path.Base(match))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// describeManifest returns the blobs referred by a single image manifest and
+// the platform extracted from its config blob. The returned platform is nil
+// if the config blob does not carry platform information.
+func describeManifest(
+	ctx context.Context, src types.ImageSource, raw []byte, mime string,
+) ([]IndexBlob, *platform.Platform, error) {
+	man, err := manifest.FromBlob(raw, mime)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	var blobs []IndexBlob
+	config := man.ConfigInfo()
+	if config.Digest != "" {
+		blobs = append(blobs, IndexBlob{Digest: config.Digest, Size: config.Size})
+	}
+	for _, layer := range man.LayerInfos() {
+		blobs = append(blobs, IndexBlob{Digest: layer.Digest, Size: layer.Size})
+	}
+	if config.Digest == "" {
+		return blobs, nil, nil
+	}
+	stream, _, err := src.GetBlob(ctx, config, nil)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	defer stream.Close()
+	data, err := io.ReadAll(stream)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	var described platform.Platform
+	if err := json.Unmarshal(data, &described); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config: %w", err)
+	}
+	if described.OS == "" && described.Architecture == "" {
+		return blobs, nil, nil
+	}
+	return blobs, &described, nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.podman.io/image/v5/manifest"
+	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/platform"
+)
+
+// putImage stores a single layer image, with the provided platform, in the
+// Storage under the provided name. Returns the image manifest.
+func putImage(
+	ctx context.Context, t *testing.T, tdir *Storage, name string, layer []byte, plat platform.Platform,
+) []byte {
+	err := tdir.Image(name)
+	assert.NoError(t, err)
+	dst, err := tdir.NewImageDestination(ctx, nil)
+	assert.NoError(t, err)
+	config, err := json.Marshal(plat)
+	assert.NoError(t, err)
+	cinfo, err := dst.PutBlob(
+		ctx, bytes.NewBuffer(config), types.BlobInfo{Size: int64(len(config))}, nil, true,
+	)
+	assert.NoError(t, err)
+	linfo, err := dst.PutBlob(
+		ctx, bytes.NewBuffer(layer), types.BlobInfo{Size: int64(len(layer))}, nil, false,
+	)
+	assert.NoError(t, err)
+	type descriptor struct {
+		MediaType string `json:"mediaType"`
+		Digest    string `json:"digest"`
+		Size      int64  `json:"size"`
+	}
+	man, err := json.Marshal(struct {
+		SchemaVersion int          `json:"schemaVersion"`
+		MediaType     string       `json:"mediaType"`
+		Config        descriptor   `json:"config"`
+		Layers        []descriptor `json:"layers"`
+	}{
+		SchemaVersion: 2,
+		MediaType:     manifest.DockerV2Schema2MediaType,
+		Config: descriptor{
+			MediaType: manifest.DockerV2Schema2ConfigMediaType,
+			Digest:    cinfo.Digest.String(),
+			Size:      cinfo.Size,
+		},
+		Layers: []descriptor{
+			{
+				MediaType: "application/vnd.docker.image.rootfs.diff.tar.gzip",
+				Digest:    linfo.Digest.String(),
+				Size:      linfo.Size,
+			},
+		},
+	})
+	assert.NoError(t, err)
+	err = dst.PutManifest(ctx, man, nil)
+	assert.NoError(t, err)
+	err = dst.Commit(ctx, nil)
+	assert.NoError(t, err)
+	return man
+}
+
+func TestDescribe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	arm64 := platform.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	man := putImage(ctx, t, tdir, "img:latest", []byte("layer"), arm64)
+	image, err := tdir.Describe(ctx, "img:latest")
+	assert.NoError(t, err)
+	dgst, err := manifest.Digest(man)
+	assert.NoError(t, err)
+	assert.Equal(t, "img:latest", image.Reference)
+	assert.Equal(t, dgst, image.Digest)
+	assert.Equal(t, []platform.Platform{arm64}, image.Platforms)
+	assert.Equal(t, "linux/arm64/v8", image.Platforms[0].String())
+	assert.Len(t, image.Blobs, 2)
+}
+
+func TestDescribeSignatures(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	putImage(ctx, t, tdir, "img:latest", []byte("layer"), platform.Platform{})
+	for _, name := range []string{"signature-2", "signature-1", "signature-foo"} {
+		fpath := path.Join(tmpdir, ImagePath("img:latest"), name)
+		err = os.WriteFile(fpath, []byte(name), 0600)
+		assert.NoError(t, err)
+	}
+	image, err := tdir.Describe(ctx, "img:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"signature-1", "signature-2"}, image.Signatures)
+}
+
+func TestIndex(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	_, err = tdir.ReadIndex()
+	assert.ErrorIs(t, err, ErrNoIndex)
+	index := &Index{
+		TagbagVersion: "v1.0.0",
+		Images: []IndexImage{
+			{Reference: "img0:latest"},
+			{Reference: "img1:latest"},
+		},
+	}
+	err = tdir.WriteIndex(index)
+	assert.NoError(t, err)
+	read, err := tdir.ReadIndex()
+	assert.NoError(t, err)
+	assert.Equal(t, IndexVersion, read.Version)
+	assert.Equal(t, index, read)
+	_, ok := read.Image("img1:latest")
+	assert.True(t, ok)
+	_, ok = read.Image("img2:latest")
+	assert.False(t, ok)
+	images, err := tdir.Images()
+	assert.NoError(t, err)
+	assert.Empty(t, images)
+}
@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+
+	"github.com/opencontainers/go-digest"
+	"go.podman.io/image/v5/manifest"
+)
+
+// OCILayoutFile is the file marking a directory as an OCI image layout.
+const OCILayoutFile = "oci-layout"
+
+// OCIIndexFile is the index of an OCI image layout, it lists the images
+// stored in the layout.
+const OCIIndexFile = "index.json"
+
+// AnnotationRefName is the annotation holding, in an OCI image layout index,
+// the reference of an image.
+const AnnotationRefName = "org.opencontainers.image.ref.name"
+
+// ociIndexMediaType is the media type of an OCI image layout index.
+const ociIndexMediaType = "application/vnd.oci.image.index.v1+json"
+
+// dirVersion is the content of the version file written by the directory
+// transport in every image directory.
+const dirVersion = "Directory Transport Version: 1.1\n"
+
+// maxManifestSize is the maximum size of a manifest we read into memory.
+const maxManifestSize = 4 << 20
+
+// instanceRegexp matches the names of the files where the directory
+// transport stores the manifests of manifest list instances.
+var instanceRegexp = regexp.MustCompile(`^([a-f0-9]{64})\.manifest\.json$`)
+
+// OCIIndex is the index of an OCI image layout.
+type OCIIndex struct {
+	SchemaVersion int             `json:"schemaVersion"`
+	MediaType     string          `json:"mediaType,omitempty"`
+	Manifests     []OCIDescriptor `json:"manifests"`
+}
+
+// OCIDescriptor refers to a manifest stored in an OCI image layout.
+type OCIDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      digest.Digest     `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ociLayout is the content of the OCILayoutFile.
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// WriteOCILayout writes an OCI image layout next to the images stored in
+// the Storage. Manifests of all images are copied into the blobs directory
+// and an index referring to each image by its reference, through the
+// AnnotationRefName annotation, is written. Image directories are kept so
+// the Storage can still be written to, they must be left out when the
+// layout is archived. Images stored using the legacy layout are not
+// exported.
+func (t *Storage) WriteOCILayout() error {
+	entries, err := os.ReadDir(path.Join(t.basedir, ImagesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read images dir: %w", err)
+	}
+	index := OCIIndex{SchemaVersion: 2, MediaType: ociIndexMediaType}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		dir := path.Join(t.basedir, ImagesDir, entry.Name())
+		ref, err := os.ReadFile(path.Join(dir, ReferenceFile))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return fmt.Errorf("failed to read image reference: %w", err)
+		}
+		descriptor, err := t.exportImage(dir)
+		if err != nil {
+			return fmt.Errorf("failed to export %s: %w", ref, err)
+		}
+		descriptor.Annotations = map[string]string{AnnotationRefName: string(ref)}
+		index.Manifests = append(index.Manifests, descriptor)
+	}
+	sort.Slice(index.Manifests, func(i, j int) bool {
+		return index.Manifests[i].Annotations[AnnotationRefName] <
+			index.Manifests[j].Annotations[AnnotationRefName]
+	})
+	if err := t.writeJSON(OCILayoutFile, ociLayout{ImageLayoutVersion: "1.0.0"}); err != nil {
+		return err
+	}
+	return t.writeJSON(OCIIndexFile, index)
+}
+
+// exportImage copies the manifests stored in the provided image directory
+// into the blobs directory. Returns the descriptor of the top level one.
+func (t *Storage) exportImage(dir string) (OCIDescriptor, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return OCIDescriptor{}, fmt.Errorf("failed to read image dir: %w", err)
+	}
+	for _, entry := range entries {
+		if !instanceRegexp.MatchString(entry.Name()) {
+			continue
+		}
+		raw, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return OCIDescriptor{}, fmt.Errorf("failed to read manifest: %w", err)
+		}
+		if _, err := t.writeBlob(raw); err != nil {
+			return OCIDescriptor{}, err
+		}
+	}
+	raw, err := os.ReadFile(path.Join(dir, "manifest.json"))
+	if err != nil {
+		return OCIDescriptor{}, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	dgst, err := t.writeBlob(raw)
+	if err != nil {
+		return OCIDescriptor{}, err
+	}
+	return OCIDescriptor{
+		MediaType: manifest.GuessMIMEType(raw),
+		Digest:    dgst,
+		Size:      int64(len(raw)),
+	}, nil
+}
+
+// writeBlob writes data into the blobs directory, returns its digest.
+func (t *Storage) writeBlob(data []byte) (digest.Digest, error) {
+	dgst := digest.FromBytes(data)
+	fpath := blobPath(t.basedir, dgst)
+	if _, err := os.Stat(fpath); err == nil {
+		return dgst, nil
+	}
+	if err := os.MkdirAll(path.Dir(fpath), 0700); err != nil {
+		return "", fmt.Errorf("failed to create blobs dir: %w", err)
+	}
+	if err := os.WriteFile(fpath, data, 0600); err != nil {
+		return "", fmt.Errorf("failed to write blob: %w", err)
+	}
+	return dgst, nil
+}
+
+// writeJSON writes value, json encoded, into the provided file relative to
+// the Storage base directory.
+func (t *Storage) writeJSON(fname string, value any) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s: %w", fname, err)
+	}
+	if err := os.WriteFile(path.Join(t.basedir, fname), data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", fname, err)
+	}
+	return nil
+}
+
+// ImportOCILayout makes the images of an OCI image layout available in the
+// Storage. An image directory is created for each image annotated with a
+// reference (AnnotationRefName), images without one are skipped. Manifests
+// are read from the blobs directory or from the blob sources, layers and
+// configs are not copied. This is a no-op if the Storage is not an OCI
+// image layout.
+func (t *Storage) ImportOCILayout() error {
+	if _, err := os.Stat(path.Join(t.basedir, OCILayoutFile)); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to stat %s: %w", OCILayoutFile, err)
+	}
+	data, err := os.ReadFile(path.Join(t.basedir, OCIIndexFile))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", OCIIndexFile, err)
+	}
+	var index OCIIndex
+	if err := json.Unmarshal(data, &index); err != nil {
+		return fmt.Errorf("failed to parse %s: %w", OCIIndexFile, err)
+	}
+	for _, descriptor := range index.Manifests {
+		ref, ok := descriptor.Annotations[AnnotationRefName]
+		if !ok {
+			continue
+		}
+		if err := t.importImage(ref, descriptor.Digest); err != nil {
+			return fmt.Errorf("failed to import %s: %w", ref, err)
+		}
+	}
+	return nil
+}
+
+// importImage creates the image directory for the image with the provided
+// reference and top level manifest digest. Instances of manifest lists not
+// present in the layout are skipped.
+func (t *Storage) importImage(ref string, dgst digest.Digest) error {
+	dir := path.Join(t.basedir, ImagePath(ref))
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("failed to create image dir: %w", err)
+	}
+	raw, err := t.readManifest(dgst)
+	if err != nil {
+		return err
+	}
+	if manifest.MIMETypeIsMultiImage(manifest.GuessMIMEType(raw)) {
+		list, err := manifest.ListFromBlob(raw, manifest.GuessMIMEType(raw))
+		if err != nil {
+			return fmt.Errorf("failed to parse manifest list: %w", err)
+		}
+		for _, instance := range list.Instances() {
+			child, err := t.readManifest(instance)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue
+				}
+				return err
+			}
+			fname := fmt.Sprintf("%s.manifest.json", instance.Encoded())
+			if err := os.WriteFile(path.Join(dir, fname), child, 0600); err != nil {
+				return fmt.Errorf("failed to write manifest: %w", err)
+			}
+		}
+	}
+	for fname, data := range map[string][]byte{
+		"version":       []byte(dirVersion),
+		"manifest.json": raw,
+	} {
+		if err := os.WriteFile(path.Join(dir, fname), data, 0600); err != nil {
+			return fmt.Errorf("failed to write %s: %w", fname, err)
+		}
+	}
+	if err := os.WriteFile(path.Join(dir, ReferenceFile), []byte(ref), 0600); err != nil {
+		return fmt.Errorf("failed to write image reference: %w", err)
+	}
+	return nil
+}
+
+// readManifest reads the manifest with the provided digest from the blobs
+// directory or from the blob sources. Returns an error satisfying
+// os.IsNotExist if the manifest can't be found.
+func (t *Storage) readManifest(dgst digest.Digest) ([]byte, error) {
+	if err := dgst.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid manifest digest: %w", err)
+	}
+	stream, _, err := openBlob(blobPath(t.basedir, dgst))
+	if os.IsNotExist(err) {
+		for _, source := range t.sources {
+			if stream, _, err = source.GetBlob(dgst); !os.IsNotExist(err) {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+	raw, err := io.ReadAll(io.LimitReader(stream, maxManifestSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if digest.FromBytes(raw) != dgst {
+		return nil, fmt.Errorf("manifest digest mismatch: expected %s", dgst)
+	}
+	return raw, nil
+}
@@ -0,0 +1,84 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/ricardomaraschini/tagbag/platform"
+)
+
+func TestOCILayout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	amd64 := platform.Platform{OS: "linux", Architecture: "amd64"}
+	man0 := putImage(ctx, t, tdir, "quay.io/org/img0:latest", []byte("layer0"), amd64)
+	man1 := putImage(ctx, t, tdir, "img1:latest", []byte("layer1"), amd64)
+	before, err := tdir.Describe(ctx, "img1:latest")
+	assert.NoError(t, err)
+
+	// image directories are kept so the storage can still be used.
+	err = tdir.WriteOCILayout()
+	assert.NoError(t, err)
+	complete, err := tdir.Complete("img1:latest")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	_, err = os.Stat(path.Join(tmpdir, OCILayoutFile))
+	assert.NoError(t, err)
+	data, err := os.ReadFile(path.Join(tmpdir, OCIIndexFile))
+	assert.NoError(t, err)
+	var index OCIIndex
+	err = json.Unmarshal(data, &index)
+	assert.NoError(t, err)
+	assert.Len(t, index.Manifests, 2)
+	for i, expected := range []struct {
+		ref string
+		man []byte
+	}{
+		{ref: "img1:latest", man: man1},
+		{ref: "quay.io/org/img0:latest", man: man0},
+	} {
+		descriptor := index.Manifests[i]
+		assert.Equal(t, expected.ref, descriptor.Annotations[AnnotationRefName])
+		assert.Equal(t, digest.FromBytes(expected.man), descriptor.Digest)
+		assert.Equal(t, int64(len(expected.man)), descriptor.Size)
+		stored, err := os.ReadFile(blobPath(tmpdir, descriptor.Digest))
+		assert.NoError(t, err)
+		assert.Equal(t, expected.man, stored)
+	}
+
+	// image directories are left out when the layout is archived.
+	err = os.RemoveAll(path.Join(tmpdir, ImagesDir))
+	assert.NoError(t, err)
+	tdir = New(tmpdir)
+	err = tdir.ImportOCILayout()
+	assert.NoError(t, err)
+	images, err := tdir.Images()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"img1:latest", "quay.io/org/img0:latest"}, images)
+	after, err := tdir.Describe(ctx, "img1:latest")
+	assert.NoError(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestImportOCILayoutNotLayout(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	err = tdir.ImportOCILayout()
+	assert.NoError(t, err)
+	images, err := tdir.Images()
+	assert.NoError(t, err)
+	assert.Empty(t, images)
+}
@@ -8,10 +8,13 @@ import (
 )
 
 // Seen is used to keep track of all blobs we have already seen across all
-// stored images.
+// stored images. It also keeps track of blobs being fetched at the moment
+// so concurrent writers do not fetch the same blob twice. Seen is safe for
+// concurrent use.
 type Seen struct {
-	mtx  sync.Mutex
-	data map[digest.Digest]types.BlobInfo
+	mtx      sync.Mutex
+	data     map[digest.Digest]types.BlobInfo
+	inflight map[digest.Digest]chan struct{}
 }
 
 // Add adds a blob to the seen list.
@@ -29,6 +32,40 @@ func (s *Seen) Get(blobDigest digest.Digest) (types.BlobInfo, bool) {
 	return blobInfo, ok
 }
 
+// Acquire returns the blob info if the blob has already been seen. If it
+// has not been seen and nobody is fetching it the blob is marked as being
+// fetched by the caller, in this case both the returned boolean is false
+// and the returned channel is nil and the caller must call Release once
+// done. If someone else is fetching the blob the returned channel is closed
+// once they are done.
+func (s *Seen) Acquire(blobDigest digest.Digest) (types.BlobInfo, bool, <-chan struct{}) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if blobInfo, ok := s.data[blobDigest]; ok {
+		return blobInfo, true, nil
+	}
+	if wait, ok := s.inflight[blobDigest]; ok {
+		return types.BlobInfo{}, false, wait
+	}
+	s.inflight[blobDigest] = make(chan struct{})
+	return types.BlobInfo{}, false, nil
+}
+
+// Release informs that the blob is not being fetched anymore, either because
+// it has been fetched (and added through Add) or because the fetch failed.
+// Releasing a blob that has not been acquired is a no-op.
+func (s *Seen) Release(blobDigest digest.Digest) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if wait, ok := s.inflight[blobDigest]; ok {
+		close(wait)
+		delete(s.inflight, blobDigest)
+	}
+}
+
 func NewSeen() *Seen {
-	return &Seen{data: map[digest.Digest]types.BlobInfo{}}
+	return &Seen{
+		data:     map[digest.Digest]types.BlobInfo{},
+		inflight: map[digest.Digest]chan struct{}{},
+	}
 }
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -9,10 +10,12 @@ import (
 	"path"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/opencontainers/go-digest"
 	"go.podman.io/image/v5/directory"
+	"go.podman.io/image/v5/manifest"
 	"go.podman.io/image/v5/types"
 )
 
@@ -22,7 +25,16 @@ type Storage struct {
 	types.ImageReference
 	seen    *Seen
 	curimg  string
+	curdir  string
 	basedir string
+	sources []BlobSource
+}
+
+// BlobSource provides blobs that are not stored inside the Storage base
+// directory. This is used, for example, to read blobs straight out of a
+// tarball without extracting them.
+type BlobSource interface {
+	GetBlob(dgst digest.Digest) (io.ReadCloser, int64, error)
 }
 
 // New returns a reference to a Storage using provided directory as base (root).
@@ -35,6 +47,81 @@ func New(basedir string) *Storage {
 	}
 }
 
+// AddBlobSource adds a source of blobs. Blobs not found in the Storage base
+// directory are looked up in the added sources, in the order they were
+// added.
+func (t *Storage) AddBlobSource(source BlobSource) {
+	t.sources = append(t.sources, source)
+}
+
+// ImagesDir is the directory, relative to the Storage base directory, under
+// which images are stored. Each image is stored in a subdirectory named
+// after the sha256 of its reference.
+const ImagesDir = "images"
+
+// ReferenceFile is the file, inside an image directory, holding the image
+// reference. It is written once the image has been completely written.
+const ReferenceFile = "reference"
+
+// BlobsDir is the directory, relative to the Storage base directory, holding
+// the blobs of all images. As in the OCI image layout blobs are stored as
+// blobs/<algorithm>/<encoded digest>.
+const BlobsDir = "blobs"
+
+// blobPath returns the path of the blob with the provided digest inside the
+// blobs directory of basedir. The digest must be valid.
+func blobPath(basedir string, dgst digest.Digest) string {
+	return path.Join(basedir, BlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// ImagePath returns the directory, relative to the Storage base directory,
+// where the provided image is stored. Image references are hashed so the
+// directory name is safe on any filesystem and never escapes the base
+// directory.
+func ImagePath(image string) string {
+	return path.Join(ImagesDir, digest.FromString(image).Encoded())
+}
+
+// LegacyImagePath returns the directory, relative to the Storage base
+// directory, where older versions stored the provided image: the image
+// reference itself with the colon of digests (as in "alpine@sha256:...")
+// replaced by a dash.
+func LegacyImagePath(image string) string {
+	name, dgst, found := strings.Cut(image, "@")
+	if !found {
+		return image
+	}
+	return name + "@" + strings.Replace(dgst, ":", "-", 1)
+}
+
+// ImageFromLegacyPath returns the image stored in the provided legacy
+// directory, this is the inverse of LegacyImagePath.
+func ImageFromLegacyPath(dir string) string {
+	name, dgst, found := strings.Cut(dir, "@")
+	if !found {
+		return dir
+	}
+	return name + "@" + strings.Replace(dgst, "-", ":", 1)
+}
+
+// imageDir returns the directory, relative to the Storage base directory,
+// where the provided image is stored. Images written by older versions are
+// found in their legacy location, new images always go to ImagePath.
+func (t *Storage) imageDir(image string) string {
+	dir := ImagePath(image)
+	if _, err := os.Stat(path.Join(t.basedir, dir)); err == nil {
+		return dir
+	}
+	legacy := LegacyImagePath(image)
+	if !filepath.IsLocal(legacy) {
+		return dir
+	}
+	if _, err := os.Stat(path.Join(t.basedir, legacy, "manifest.json")); err == nil {
+		return legacy
+	}
+	return dir
+}
+
 // CurrentImage returns the inner image we are operating on.
 func (t *Storage) CurrentImage() string {
 	if t.ImageReference == nil {
@@ -43,10 +130,132 @@ func (t *Storage) CurrentImage() string {
 	return t.curimg
 }
 
-// Images list all images stored in the Storage. Traverses the Storage base
-// directory and returns all subdirectories that do not contain a subdir or
-// name starts with ".".
+// Images list all images stored in the Storage. Images are read from their
+// reference files, directories without one are skipped as they hold images
+// that have not been completely written. Images stored by older versions
+// are also returned, see legacyImages.
 func (t *Storage) Images() ([]string, error) {
+	var images []string
+	entries, err := os.ReadDir(path.Join(t.basedir, ImagesDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read images dir: %w", err)
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		fpath := path.Join(t.basedir, ImagesDir, entry.Name(), ReferenceFile)
+		ref, err := os.ReadFile(fpath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read image reference: %w", err)
+		}
+		images = append(images, string(ref))
+	}
+	sort.Strings(images)
+	legacy, err := t.legacyImages()
+	if err != nil {
+		return nil, err
+	}
+	return append(images, legacy...), nil
+}
+
+// Complete returns true if the provided image has been completely written
+// into the Storage: its reference file exists and all blobs referred by its
+// manifests are present in the blobs directory. Blobs may go missing after
+// the image has been written, e.g. removed by RestoreSeen for not matching
+// their digests, the image must then be written again. Used to skip images
+// already pulled when resuming an interrupted pull.
+func (t *Storage) Complete(image string) (bool, error) {
+	dir := path.Join(t.basedir, ImagePath(image))
+	ref, err := os.ReadFile(path.Join(dir, ReferenceFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to read image reference: %w", err)
+	}
+	if string(ref) != image {
+		return false, nil
+	}
+	blobs, err := manifestBlobs(dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return false, nil
+		}
+		return false, err
+	}
+	for _, dgst := range blobs {
+		if _, err := os.Stat(blobPath(t.basedir, dgst)); err != nil {
+			if os.IsNotExist(err) {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to stat blob: %w", err)
+		}
+	}
+	return true, nil
+}
+
+// manifestBlobs returns the digests of the blobs referred by the manifest
+// stored in the provided image directory. For manifest lists the blobs
+// referred by the stored instances are returned, instances not stored (when
+// only a subset of them has been pulled) are skipped.
+func manifestBlobs(dir string) ([]digest.Digest, error) {
+	raw, err := os.ReadFile(path.Join(dir, "manifest.json"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	mime := manifest.GuessMIMEType(raw)
+	if !manifest.MIMETypeIsMultiImage(mime) {
+		return imageBlobs(raw, mime)
+	}
+	list, err := manifest.ListFromBlob(raw, mime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest list: %w", err)
+	}
+	var blobs []digest.Digest
+	for _, instance := range list.Instances() {
+		fpath := path.Join(dir, instance.Encoded()+".manifest.json")
+		raw, err := os.ReadFile(fpath)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to read child manifest: %w", err)
+		}
+		instblobs, err := imageBlobs(raw, manifest.GuessMIMEType(raw))
+		if err != nil {
+			return nil, err
+		}
+		blobs = append(blobs, instblobs...)
+	}
+	return blobs, nil
+}
+
+// imageBlobs returns the digests of the config and layers referred by a
+// single image manifest.
+func imageBlobs(raw []byte, mime string) ([]digest.Digest, error) {
+	man, err := manifest.FromBlob(raw, mime)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest: %w", err)
+	}
+	var blobs []digest.Digest
+	if config := man.ConfigInfo(); config.Digest != "" {
+		blobs = append(blobs, config.Digest)
+	}
+	for _, layer := range man.LayerInfos() {
+		blobs = append(blobs, layer.Digest)
+	}
+	return blobs, nil
+}
+
+// legacyImages list all images stored by older versions, directly under the
+// Storage base directory. Traverses the Storage base directory and returns
+// all subdirectories that do not contain a subdir or name starts with ".".
+// The images and blobs directories are skipped.
+func (t *Storage) legacyImages() ([]string, error) {
 	var images []string
 	walker := func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -58,6 +267,15 @@ func (t *Storage) Images() ([]string, error) {
 		if strings.HasPrefix(dirname, ".") {
 			return filepath.SkipDir
 		}
+		image, err := filepath.Rel(t.basedir, path)
+		if err != nil {
+			return fmt.Errorf("failed to get rel path: %w", err)
+		}
+		if image == ImagesDir || image == BlobsDir {
+			return filepath.SkipDir
+		} else if image == "." {
+			return nil
+		}
 		entries, err := os.ReadDir(path)
 		if err != nil {
 			return fmt.Errorf("failed to read dir: %w", err)
@@ -67,11 +285,7 @@ func (t *Storage) Images() ([]string, error) {
 				return nil
 			}
 		}
-		image, err := filepath.Rel(t.basedir, path)
-		if err != nil {
-			return fmt.Errorf("failed to get rel path: %w", err)
-		}
-		images = append(images, image)
+		images = append(images, ImageFromLegacyPath(image))
 		return nil
 	}
 	if err := filepath.WalkDir(t.basedir, walker); err != nil {
@@ -80,6 +294,125 @@ func (t *Storage) Images() ([]string, error) {
 	return images, nil
 }
 
+// RestoreSeen rebuilds the seen blobs cache from the blobs directory, this
+// is used to resume an interrupted pull into the same base directory. The
+// content of each blob is checked against its digest, blobs that do not
+// match are removed and thus fetched again. Temporary files left behind by
+// interrupted writes are removed as well. Returns the number of restored
+// and removed blobs.
+func (t *Storage) RestoreSeen() (int, int, error) {
+	var restored, removed int
+	dir := path.Join(t.basedir, BlobsDir)
+	walker := func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && fpath == dir {
+				return filepath.SkipDir
+			}
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+		algo := digest.Algorithm(filepath.Base(filepath.Dir(fpath)))
+		dgst := digest.NewDigestFromEncoded(algo, d.Name())
+		if strings.HasPrefix(d.Name(), ".tmp-") || dgst.Validate() != nil {
+			if err := os.Remove(fpath); err != nil {
+				return fmt.Errorf("failed to remove %s: %w", fpath, err)
+			}
+			return nil
+		}
+		fp, err := os.Open(fpath)
+		if err != nil {
+			return fmt.Errorf("failed to open blob: %w", err)
+		}
+		defer fp.Close()
+		digester := algo.Digester()
+		size, err := io.Copy(digester.Hash(), fp)
+		if err != nil {
+			return fmt.Errorf("failed to read blob: %w", err)
+		}
+		if digester.Digest() != dgst {
+			if err := os.Remove(fpath); err != nil {
+				return fmt.Errorf("failed to remove corrupt blob: %w", err)
+			}
+			removed++
+			return nil
+		}
+		t.seen.Add(dgst, types.BlobInfo{Digest: dgst, Size: size})
+		restored++
+		return nil
+	}
+	if err := filepath.WalkDir(dir, walker); err != nil {
+		return 0, 0, fmt.Errorf("fail to traverse blobs: %w", err)
+	}
+	return restored, removed, nil
+}
+
+// Prune removes from the Storage everything not belonging to the provided
+// images: the directories of other images, blobs none of the images refer
+// to and any other file (e.g. an index or an OCI image layout). This drops
+// what an interrupted pull left behind and the pull resumed into the same
+// base directory did not write again. Returns the number of removed image
+// directories.
+func (t *Storage) Prune(images []string) (int, error) {
+	keep := map[string]bool{}
+	blobs := map[digest.Digest]bool{}
+	for _, image := range images {
+		dir := ImagePath(image)
+		keep[path.Base(dir)] = true
+		refs, err := manifestBlobs(path.Join(t.basedir, dir))
+		if err != nil {
+			return 0, err
+		}
+		for _, dgst := range refs {
+			blobs[dgst] = true
+		}
+	}
+	entries, err := os.ReadDir(t.basedir)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read base dir: %w", err)
+	}
+	for _, entry := range entries {
+		if entry.Name() == ImagesDir || entry.Name() == BlobsDir {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(t.basedir, entry.Name())); err != nil {
+			return 0, fmt.Errorf("failed to remove %s: %w", entry.Name(), err)
+		}
+	}
+	var removed int
+	if entries, err = os.ReadDir(path.Join(t.basedir, ImagesDir)); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("failed to read images dir: %w", err)
+	}
+	for _, entry := range entries {
+		if keep[entry.Name()] {
+			continue
+		}
+		if err := os.RemoveAll(path.Join(t.basedir, ImagesDir, entry.Name())); err != nil {
+			return 0, fmt.Errorf("failed to remove image dir: %w", err)
+		}
+		removed++
+	}
+	walker := func(fpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+		algo := digest.Algorithm(filepath.Base(filepath.Dir(fpath)))
+		if blobs[digest.NewDigestFromEncoded(algo, d.Name())] {
+			return nil
+		}
+		if err := os.Remove(fpath); err != nil {
+			return fmt.Errorf("failed to remove blob: %w", err)
+		}
+		return nil
+	}
+	if err := filepath.WalkDir(path.Join(t.basedir, BlobsDir), walker); err != nil && !os.IsNotExist(err) {
+		return 0, fmt.Errorf("fail to traverse blobs: %w", err)
+	}
+	return removed, nil
+}
+
 // DeleteBlob deletes a blob from the current Storage. The file name must be
 // a blob file name, i.e. a file name that is a valid digest.
 func (t *Storage) DeleteBlob(name string) error {
@@ -149,9 +482,9 @@ func (t *Storage) Files() (map[string]os.FileInfo, error) {
 
 // Image sets the current inner Image inside the Storage. A Storage allows
 // "write to" and "read from" on a single Image at a given time. Creates or
-// uses an already existent subdirectory named after the Image name.
+// uses an already existent subdirectory, see ImagePath.
 func (t *Storage) Image(image string) error {
-	gendir := path.Join(t.basedir, image)
+	gendir := path.Join(t.basedir, t.imageDir(image))
 	if _, err := os.Stat(gendir); err != nil {
 		if !os.IsNotExist(err) {
 			return fmt.Errorf("failed to stat dir: %w", err)
@@ -168,9 +501,46 @@ func (t *Storage) Image(image string) error {
 	}
 	t.ImageReference = inref
 	t.curimg = image
+	t.curdir = gendir
 	return nil
 }
 
+// Reference returns a new Storage sharing the base directory, the seen blobs
+// cache and the blob sources with this one but pointing to the provided
+// Image. Different references can be used concurrently to write different
+// Images, blobs fetched through one of them are reused by the others.
+func (t *Storage) Reference(image string) (*Storage, error) {
+	ref := &Storage{
+		basedir: t.basedir,
+		seen:    t.seen,
+		sources: t.sources,
+	}
+	if err := ref.Image(image); err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+// imageSource returns a handler used to read from the provided image. The
+// Storage current image is not changed.
+func (t *Storage) imageSource(
+	ctx context.Context, image string,
+) (types.ImageSource, error) {
+	ref, err := directory.NewReference(path.Join(t.basedir, t.imageDir(image)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create dir ref: %w", err)
+	}
+	src, err := ref.NewImageSource(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &srcwrap{
+		basedir:     t.basedir,
+		sources:     t.sources,
+		ImageSource: src,
+	}, nil
+}
+
 // NewImageSource returns a handler used to read from the Storage current
 // Image. Current image must already be set by caller by means of a call
 // to Image function.
@@ -181,7 +551,11 @@ func (t *Storage) NewImageSource(
 	if err != nil {
 		return nil, err
 	}
-	return &srcwrap{basedir: t.basedir, ImageSource: src}, nil
+	return &srcwrap{
+		basedir:     t.basedir,
+		sources:     t.sources,
+		ImageSource: src,
+	}, nil
 }
 
 // NewImageDestination returns a handler used to write to the current
@@ -198,24 +572,33 @@ func (t *Storage) NewImageDestination(
 		ImageDestination: dst,
 		seen:             t.seen,
 		image:            t.curimg,
+		dir:              t.curdir,
+		basedir:          t.basedir,
+		claims:           map[digest.Digest]bool{},
 	}, nil
 }
 
 // destwrap wraps an ImageDestination and adds a check for already
-// pulled blobs. Already pulled blobs are kept on "seen" property.
-// As DirectoryTransport does not support concurrent access I did
-// not take any special care here regarding the usage of "seen"
-// property. XXX sync.Mutex, alstublieft.
+// pulled blobs. Already pulled blobs are kept on "seen" property,
+// which may be shared with destinations of other images being
+// written concurrently. Blobs this destination is responsible for
+// fetching are kept on "claims" until they are written. Blobs are
+// not written to the image directory but to the blobs directory
+// shared by all images.
 type destwrap struct {
 	types.ImageDestination
-	image string
-	seen  *Seen
+	image   string
+	dir     string
+	basedir string
+	seen    *Seen
+	claims  map[digest.Digest]bool
 }
 
-// PutBlob calls underlying ImageDestination PutBlob function and
-// if the call succeeds it register the blob as already seen.
-// Package containers/image access the TryReusingBlob before this
-// one so we do the cache check there.
+// PutBlob writes the blob into the blobs directory and if the call
+// succeeds it register the blob as already seen. Package
+// containers/image access the TryReusingBlob before this one so we
+// do the cache check there. The claim on the blob, if any, is
+// released regardless of the outcome.
 func (d *destwrap) PutBlob(
 	ctx context.Context,
 	stream io.Reader,
@@ -223,46 +606,144 @@ func (d *destwrap) PutBlob(
 	cache types.BlobInfoCache,
 	iscfg bool,
 ) (types.BlobInfo, error) {
-	binfo, err := d.ImageDestination.PutBlob(
-		ctx, stream, info, cache, iscfg,
-	)
+	defer d.release(info.Digest)
+	binfo, err := d.putBlob(stream, info)
 	if err != nil {
-		return binfo, err
+		return types.BlobInfo{}, err
 	}
 	d.seen.Add(binfo.Digest, binfo)
 	return binfo, nil
 }
 
+// putBlob writes the blob into the blobs directory. The blob is first
+// written to a temporary file and then, once its digest is verified,
+// renamed. Blobs in the blobs directory are therefore always complete.
+func (d *destwrap) putBlob(stream io.Reader, info types.BlobInfo) (types.BlobInfo, error) {
+	algo := digest.Canonical
+	if info.Digest != "" {
+		if err := info.Digest.Validate(); err != nil {
+			return types.BlobInfo{}, fmt.Errorf("invalid blob digest: %w", err)
+		}
+		algo = info.Digest.Algorithm()
+	}
+	dir := path.Join(d.basedir, BlobsDir, algo.String())
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return types.BlobInfo{}, fmt.Errorf("failed to create blobs dir: %w", err)
+	}
+	fp, err := os.CreateTemp(dir, ".tmp-*")
+	if err != nil {
+		return types.BlobInfo{}, fmt.Errorf("failed to create blob file: %w", err)
+	}
+	defer os.Remove(fp.Name())
+	digester := algo.Digester()
+	size, err := io.Copy(fp, io.TeeReader(stream, digester.Hash()))
+	if err != nil {
+		fp.Close()
+		return types.BlobInfo{}, fmt.Errorf("failed to write blob: %w", err)
+	}
+	if err := fp.Close(); err != nil {
+		return types.BlobInfo{}, fmt.Errorf("failed to close blob file: %w", err)
+	}
+	dgst := digester.Digest()
+	if info.Digest != "" && dgst != info.Digest {
+		return types.BlobInfo{}, fmt.Errorf("blob digest mismatch: expected %s, got %s", info.Digest, dgst)
+	}
+	if err := os.Rename(fp.Name(), blobPath(d.basedir, dgst)); err != nil {
+		return types.BlobInfo{}, fmt.Errorf("failed to move blob: %w", err)
+	}
+	return types.BlobInfo{Digest: dgst, Size: size}, nil
+}
+
 // TryReusingBlob checks if a blob has already been "seen", pulled.
 // If yes then returns true informing that we can "reuse" the blob.
 // With that containers/image won't attempt to pull the blob thus
-// calling PutBlob.
+// calling PutBlob. If the blob is being fetched by another image
+// destination we wait for it to finish before checking again. Blobs
+// not seen but present in the blobs directory are reused as well.
 func (d *destwrap) TryReusingBlob(
 	ctx context.Context,
 	info types.BlobInfo,
 	cache types.BlobInfoCache,
 	substitute bool,
 ) (bool, types.BlobInfo, error) {
-	if binfo, ok := d.seen.Get(info.Digest); ok {
-		return true, binfo, nil
+	for {
+		binfo, ok, wait := d.seen.Acquire(info.Digest)
+		if ok {
+			return true, binfo, nil
+		} else if wait == nil {
+			d.claims[info.Digest] = true
+			break
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return false, info, ctx.Err()
+		}
+	}
+	if info.Digest.Validate() != nil {
+		return false, info, nil
+	}
+	stat, err := os.Stat(blobPath(d.basedir, info.Digest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return false, info, nil
+		}
+		return false, info, fmt.Errorf("failed to stat blob: %w", err)
+	}
+	binfo := types.BlobInfo{Digest: info.Digest, Size: stat.Size()}
+	d.seen.Add(binfo.Digest, binfo)
+	d.release(info.Digest)
+	return true, binfo, nil
+}
+
+// Commit calls underlying ImageDestination Commit function and, if
+// it succeeds, writes the image reference file. As it is written last
+// its presence means the image has been completely written.
+func (d *destwrap) Commit(
+	ctx context.Context, unparsed types.UnparsedImage,
+) error {
+	if err := d.ImageDestination.Commit(ctx, unparsed); err != nil {
+		return err
+	}
+	fpath := path.Join(d.dir, ReferenceFile)
+	if err := os.WriteFile(fpath, []byte(d.image), 0600); err != nil {
+		return fmt.Errorf("failed to write image reference: %w", err)
+	}
+	return nil
+}
+
+// release releases the claim on the provided blob, if we hold it.
+func (d *destwrap) release(dgst digest.Digest) {
+	if !d.claims[dgst] {
+		return
+	}
+	delete(d.claims, dgst)
+	d.seen.Release(dgst)
+}
+
+// Close releases all claims still held, so other destinations waiting
+// for them can move on, and closes the underlying ImageDestination.
+func (d *destwrap) Close() error {
+	for dgst := range d.claims {
+		d.release(dgst)
 	}
-	return d.ImageDestination.TryReusingBlob(
-		ctx, info, cache, substitute,
-	)
+	return d.ImageDestination.Close()
 }
 
 // srcwrap is a wrap around a ImageSource interface. It is specifically
-// designed to leverage blobs already pulled in any of the existing
-// Images inside a Storage. This wraps searchs for Digest named files
-// from "basedir" inwards.
+// designed to read blobs from the blobs directory shared by all Images.
+// Blobs stored by older versions, inside the image directories, are
+// searched from "basedir" inwards after looking in the additional blob
+// sources.
 type srcwrap struct {
 	basedir string
+	sources []BlobSource
 	types.ImageSource
 }
 
 // findBlob attempts to find a blob in any of the already pulled Images.
-// Returns either the blob path or an error. XXX this should be optimized
-// to avoid reading all blobs every time.
+// Returns either the blob path or an error. This is only needed for
+// Storages written by older versions, which did not use a blobs dir.
 func (s *srcwrap) findBlob(dgst digest.Digest) (string, error) {
 	var blobpath string
 	walker := func(path string, info fs.FileInfo, err error) error {
@@ -280,29 +761,51 @@ func (s *srcwrap) findBlob(dgst digest.Digest) (string, error) {
 	return blobpath, nil
 }
 
-// GetBlob attempts to return a reader for a blob file in a given Image.
-// This function first tries to check if the blob is present in the current
-// Image, if it is not then searches for it in all other images.
+// openBlob opens the blob file in the provided path.
+func openBlob(fpath string) (io.ReadCloser, int64, error) {
+	fp, err := os.Open(fpath)
+	if err != nil {
+		return nil, -1, err
+	}
+	fi, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, -1, err
+	}
+	return fp, fi.Size(), nil
+}
+
+// GetBlob attempts to return a reader for a blob. This function first
+// looks in the blobs directory, then in the current Image directory, then
+// in the additional blob sources and at last in all other images.
 func (s *srcwrap) GetBlob(
 	ctx context.Context, info types.BlobInfo, icache types.BlobInfoCache,
 ) (io.ReadCloser, int64, error) {
+	if info.Digest.Validate() == nil {
+		stream, size, err := openBlob(blobPath(s.basedir, info.Digest))
+		if err == nil {
+			return stream, size, nil
+		} else if !os.IsNotExist(err) {
+			return nil, -1, err
+		}
+	}
 	stream, size, err := s.ImageSource.GetBlob(ctx, info, icache)
 	if err == nil {
 		return stream, size, nil
 	} else if !os.IsNotExist(err) {
 		return stream, size, err
 	}
-	blobpath, err := s.findBlob(info.Digest)
-	if err != nil {
-		return nil, -1, err
-	}
-	fp, err := os.Open(blobpath)
-	if err != nil {
-		return nil, -1, err
+	for _, source := range s.sources {
+		stream, size, err := source.GetBlob(info.Digest)
+		if err == nil {
+			return stream, size, nil
+		} else if !os.IsNotExist(err) {
+			return nil, -1, err
+		}
 	}
-	fi, err := fp.Stat()
+	blobpath, err := s.findBlob(info.Digest)
 	if err != nil {
 		return nil, -1, err
 	}
-	return fp, fi.Size(), nil
+	return openBlob(blobpath)
 }
@@ -3,6 +3,7 @@ package storage
 import (
 	"bytes"
 	"context"
+	"io"
 	"os"
 	"path"
 	"reflect"
@@ -13,6 +14,8 @@ import (
 	"github.com/opencontainers/go-digest"
 	"github.com/stretchr/testify/assert"
 	"go.podman.io/image/v5/types"
+
+	"github.com/ricardomaraschini/tagbag/platform"
 )
 
 func TestNewImages(t *testing.T) {
@@ -25,12 +28,63 @@ func TestNewImages(t *testing.T) {
 		assert.NoError(t, err)
 	}
 	for _, img := range []string{"img1:latest", "img2:latest"} {
-		dname := path.Join(tmpdir, img)
+		dname := path.Join(tmpdir, ImagePath(img))
 		_, err := os.Stat(dname)
 		assert.NoError(t, err)
 	}
 }
 
+func TestLegacyImagePath(t *testing.T) {
+	for image, dir := range map[string]string{
+		"img:latest": "img:latest",
+		"quay.io/org/app@" + digest.FromString("app").String(): "quay.io/org/app@sha256-" + digest.FromString("app").Hex(),
+		"img:1@" + digest.FromString("app").String():           "img:1@sha256-" + digest.FromString("app").Hex(),
+	} {
+		assert.Equal(t, dir, LegacyImagePath(image))
+		assert.Equal(t, image, ImageFromLegacyPath(dir))
+	}
+}
+
+func TestImages(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	// app is a prefix of app/worker, this used to confuse the legacy
+	// layout.
+	refs := []string{"app:1", "app/worker:1", "../escape:1", "app@" + digest.FromString("app").String()}
+	for _, ref := range refs {
+		err := tdir.Image(ref)
+		assert.NoError(t, err)
+		dst, err := tdir.NewImageDestination(ctx, nil)
+		assert.NoError(t, err)
+		err = dst.Commit(ctx, nil)
+		assert.NoError(t, err)
+		data, err := os.ReadFile(path.Join(tmpdir, ImagePath(ref), ReferenceFile))
+		assert.NoError(t, err)
+		assert.Equal(t, ref, string(data))
+	}
+	// an image that has not been completely written.
+	err = tdir.Image("partial:1")
+	assert.NoError(t, err)
+	// an image stored using the legacy layout.
+	legacy := path.Join(tmpdir, "quay.io", "org", "old:1")
+	err = os.MkdirAll(legacy, 0700)
+	assert.NoError(t, err)
+	err = os.WriteFile(path.Join(legacy, "manifest.json"), []byte("{}"), 0600)
+	assert.NoError(t, err)
+	images, err := tdir.Images()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, append(refs, "quay.io/org/old:1"), images)
+	err = tdir.Image("quay.io/org/old:1")
+	assert.NoError(t, err)
+	assert.Equal(t, legacy, tdir.curdir)
+	_, err = os.Stat(path.Join(tmpdir, ImagePath("quay.io/org/old:1")))
+	assert.True(t, os.IsNotExist(err))
+}
+
 func TestPutBlob(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
@@ -52,7 +106,7 @@ func TestPutBlob(t *testing.T) {
 	dstw := dst.(*destwrap)
 	_, ok := dstw.seen.Get(binfo.Digest)
 	assert.True(t, ok)
-	blobpath := path.Join(tmpdir, "img:latest", binfo.Digest.Hex())
+	blobpath := path.Join(tmpdir, BlobsDir, "sha256", binfo.Digest.Hex())
 	stored, err := os.ReadFile(blobpath)
 	assert.NoError(t, err)
 	if !reflect.DeepEqual(content, stored) {
@@ -92,6 +146,122 @@ func TestTryReusingBlob(t *testing.T) {
 	assert.True(t, reuse)
 }
 
+func TestTryReusingBlobInFlight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	ref0, err := tdir.Reference("img0")
+	assert.NoError(t, err)
+	ref1, err := tdir.Reference("img1")
+	assert.NoError(t, err)
+	dst0, err := ref0.NewImageDestination(ctx, nil)
+	assert.NoError(t, err)
+	dst1, err := ref1.NewImageDestination(ctx, nil)
+	assert.NoError(t, err)
+	content := []byte("testing")
+	binfo := types.BlobInfo{
+		Digest: digest.FromBytes(content),
+		Size:   int64(len(content)),
+	}
+	reuse, _, err := dst0.TryReusingBlob(ctx, binfo, nil, false)
+	assert.NoError(t, err)
+	assert.False(t, reuse)
+	reused := make(chan bool)
+	go func() {
+		reuse, _, err := dst1.TryReusingBlob(ctx, binfo, nil, false)
+		assert.NoError(t, err)
+		reused <- reuse
+	}()
+	select {
+	case <-reused:
+		t.Fatal("blob reused before being written")
+	case <-time.After(100 * time.Millisecond):
+	}
+	_, err = dst0.PutBlob(ctx, bytes.NewBuffer(content), binfo, nil, false)
+	assert.NoError(t, err)
+	assert.True(t, <-reused)
+}
+
+func TestTryReusingBlobReleasedOnClose(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	ref0, err := tdir.Reference("img0")
+	assert.NoError(t, err)
+	ref1, err := tdir.Reference("img1")
+	assert.NoError(t, err)
+	dst0, err := ref0.NewImageDestination(ctx, nil)
+	assert.NoError(t, err)
+	dst1, err := ref1.NewImageDestination(ctx, nil)
+	assert.NoError(t, err)
+	binfo := types.BlobInfo{Digest: digest.FromString("testing")}
+	reuse, _, err := dst0.TryReusingBlob(ctx, binfo, nil, false)
+	assert.NoError(t, err)
+	assert.False(t, reuse)
+	err = dst0.Close()
+	assert.NoError(t, err)
+	reuse, _, err = dst1.TryReusingBlob(ctx, binfo, nil, false)
+	assert.NoError(t, err)
+	assert.False(t, reuse)
+}
+
+func TestPutBlobDigestMismatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	err = tdir.Image("img0")
+	assert.NoError(t, err)
+	dst, err := tdir.NewImageDestination(ctx, nil)
+	assert.NoError(t, err)
+	binfo := types.BlobInfo{Digest: digest.FromString("other")}
+	_, err = dst.PutBlob(ctx, bytes.NewBufferString("testing"), binfo, nil, false)
+	assert.Error(t, err)
+	entries, err := os.ReadDir(path.Join(tmpdir, BlobsDir, "sha256"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestTryReusingBlobFromBlobsDir(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	content := []byte("testing")
+	dgst := digest.FromBytes(content)
+	err = os.MkdirAll(path.Join(tmpdir, BlobsDir, "sha256"), 0700)
+	assert.NoError(t, err)
+	err = os.WriteFile(path.Join(tmpdir, BlobsDir, "sha256", dgst.Hex()), content, 0600)
+	assert.NoError(t, err)
+	tdir := New(tmpdir)
+	err = tdir.Image("img0")
+	assert.NoError(t, err)
+	dst, err := tdir.NewImageDestination(ctx, nil)
+	assert.NoError(t, err)
+	reuse, binfo, err := dst.TryReusingBlob(ctx, types.BlobInfo{Digest: dgst}, nil, false)
+	assert.NoError(t, err)
+	assert.True(t, reuse)
+	assert.Equal(t, int64(len(content)), binfo.Size)
+	src, err := tdir.NewImageSource(ctx, nil)
+	assert.NoError(t, err)
+	fp, size, err := src.GetBlob(ctx, binfo, nil)
+	assert.NoError(t, err)
+	defer fp.Close()
+	assert.Equal(t, int64(len(content)), size)
+	images, err := tdir.Images()
+	assert.NoError(t, err)
+	assert.NotContains(t, images, path.Join(BlobsDir, "sha256"))
+}
+
 func Test_findBlob(t *testing.T) {
 	tmpdir, err := os.MkdirTemp("", "")
 	assert.NoError(t, err)
@@ -148,3 +318,147 @@ func TestGetBlob(t *testing.T) {
 	assert.NoError(t, err)
 	fp.Close()
 }
+
+// mapSource is a BlobSource backed by a map.
+type mapSource map[digest.Digest][]byte
+
+func (m mapSource) GetBlob(dgst digest.Digest) (io.ReadCloser, int64, error) {
+	content, ok := m[dgst]
+	if !ok {
+		return nil, -1, os.ErrNotExist
+	}
+	return io.NopCloser(bytes.NewReader(content)), int64(len(content)), nil
+}
+
+func TestGetBlobFromSource(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	content := []byte("testing")
+	dgst := digest.FromBytes(content)
+	tdir := New(tmpdir)
+	tdir.AddBlobSource(mapSource{})
+	tdir.AddBlobSource(mapSource{dgst: content})
+	err = tdir.Image("0")
+	assert.NoError(t, err)
+	src, err := tdir.NewImageSource(ctx, nil)
+	assert.NoError(t, err)
+	fp, size, err := src.GetBlob(ctx, types.BlobInfo{Digest: dgst}, nil)
+	assert.NoError(t, err)
+	defer fp.Close()
+	assert.Equal(t, int64(len(content)), size)
+	stored, err := io.ReadAll(fp)
+	assert.NoError(t, err)
+	assert.Equal(t, content, stored)
+	missing := types.BlobInfo{Digest: digest.FromString("missing")}
+	_, _, err = src.GetBlob(ctx, missing, nil)
+	assert.Error(t, err)
+}
+
+func TestRestoreSeen(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	restored, removed, err := tdir.RestoreSeen()
+	assert.NoError(t, err)
+	assert.Zero(t, restored)
+	assert.Zero(t, removed)
+
+	valid := digest.FromString("valid")
+	corrupt := digest.FromString("corrupt")
+	err = os.MkdirAll(path.Dir(blobPath(tmpdir, valid)), 0700)
+	assert.NoError(t, err)
+	err = os.WriteFile(blobPath(tmpdir, valid), []byte("valid"), 0600)
+	assert.NoError(t, err)
+	err = os.WriteFile(blobPath(tmpdir, corrupt), []byte("truncated"), 0600)
+	assert.NoError(t, err)
+	tmpfile := path.Join(path.Dir(blobPath(tmpdir, valid)), ".tmp-123")
+	err = os.WriteFile(tmpfile, []byte("partial"), 0600)
+	assert.NoError(t, err)
+
+	restored, removed, err = tdir.RestoreSeen()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, restored)
+	assert.Equal(t, 1, removed)
+	binfo, ok := tdir.seen.Get(valid)
+	assert.True(t, ok)
+	assert.Equal(t, int64(len("valid")), binfo.Size)
+	_, ok = tdir.seen.Get(corrupt)
+	assert.False(t, ok)
+	_, err = os.Stat(blobPath(tmpdir, corrupt))
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(tmpfile)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestPrune(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	amd64 := platform.Platform{OS: "linux", Architecture: "amd64"}
+	putImage(ctx, t, tdir, "app:1", []byte("layer1"), amd64)
+	putImage(ctx, t, tdir, "app:2", []byte("layer2"), amd64)
+	err = tdir.WriteOCILayout()
+	assert.NoError(t, err)
+	err = tdir.WriteIndex(&Index{})
+	assert.NoError(t, err)
+
+	removed, err := tdir.Prune([]string{"app:1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	images, err := tdir.Images()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"app:1"}, images)
+	complete, err := tdir.Complete("app:1")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	_, err = os.Stat(blobPath(tmpdir, digest.FromBytes([]byte("layer2"))))
+	assert.True(t, os.IsNotExist(err))
+	for _, fname := range []string{OCILayoutFile, OCIIndexFile, IndexPath} {
+		_, err = os.Stat(path.Join(tmpdir, fname))
+		assert.True(t, os.IsNotExist(err), fname)
+	}
+}
+
+func TestComplete(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tdir := New(tmpdir)
+	err = tdir.Image("app:1")
+	assert.NoError(t, err)
+	complete, err := tdir.Complete("app:1")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	layer := []byte("layer")
+	putImage(ctx, t, tdir, "app:1", layer, platform.Platform{OS: "linux", Architecture: "amd64"})
+	complete, err = tdir.Complete("app:1")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+	complete, err = tdir.Complete("app:2")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+
+	// a corrupt blob removed when resuming makes the image incomplete.
+	err = os.WriteFile(blobPath(tmpdir, digest.FromBytes(layer)), []byte("corrupt"), 0600)
+	assert.NoError(t, err)
+	tdir = New(tmpdir)
+	_, removed, err := tdir.RestoreSeen()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	complete, err = tdir.Complete("app:1")
+	assert.NoError(t, err)
+	assert.False(t, complete)
+	putImage(ctx, t, tdir, "app:1", layer, platform.Platform{OS: "linux", Architecture: "amd64"})
+	complete, err = tdir.Complete("app:1")
+	assert.NoError(t, err)
+	assert.True(t, complete)
+}
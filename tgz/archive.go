@@ -0,0 +1,476 @@
+package tgz
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// TOCVersion is the version of the table of contents written by Compress.
+const TOCVersion = 1
+
+// TOCPath is the name of the tar entry holding the table of contents.
+const TOCPath = ".tagbag/toc.json"
+
+// ErrNotSeekable is returned by Open when a compressed tarball does not
+// carry a table of contents. This is the case for tarballs created by older
+// versions of tagbag or by other tools.
+var ErrNotSeekable = errors.New("tarball does not contain a table of contents")
+
+// TOC is the table of contents of a tarball. For each regular file stored
+// in the tarball it keeps the offset of the frame where the file is.
+type TOC struct {
+	Version int        `json:"version"`
+	Entries []TOCEntry `json:"entries"`
+}
+
+// TOCEntry describes a single file stored in a tarball. Offset is the
+// position, in the compressed file, of the frame holding the file tar header
+// and content. Size is the uncompressed file size.
+type TOCEntry struct {
+	Name   string `json:"name"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// frameSplitter writes data into compressed frames. A new frame is started
+// every time next is called. Concatenated frames are a valid compressed
+// stream, regular tools see a single compressed tarball.
+type frameSplitter struct {
+	codec  *Codec
+	dst    io.Writer
+	offset int64
+	frame  frameWriter
+}
+
+// newFrameSplitter returns a frameSplitter writing into dst using codec.
+func newFrameSplitter(dst io.Writer, codec *Codec) (*frameSplitter, error) {
+	fs := &frameSplitter{codec: codec, dst: dst}
+	frame, err := codec.newWriter(fs.counter())
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s writer: %w", codec.name, err)
+	}
+	fs.frame = frame
+	return fs, nil
+}
+
+// counter returns a writer that writes to dst keeping track of the number
+// of written bytes.
+func (f *frameSplitter) counter() io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		n, err := f.dst.Write(p)
+		f.offset += int64(n)
+		return n, err
+	})
+}
+
+// Write writes into the current frame.
+func (f *frameSplitter) Write(p []byte) (int, error) {
+	return f.frame.Write(p)
+}
+
+// next closes the current frame and starts a new one. Returns the offset
+// where the new frame starts.
+func (f *frameSplitter) next() (int64, error) {
+	if err := f.frame.Close(); err != nil {
+		return 0, fmt.Errorf("failed to close frame: %w", err)
+	}
+	f.frame.Reset(f.counter())
+	return f.offset, nil
+}
+
+// Close closes the current frame and, if the codec supports it, writes the
+// footer pointing to the frame starting at tocOffset.
+func (f *frameSplitter) Close(tocOffset int64) error {
+	if err := f.frame.Close(); err != nil {
+		return fmt.Errorf("failed to close frame: %w", err)
+	}
+	if f.codec.footer == nil {
+		return nil
+	}
+	footer, err := f.codec.footer(tocOffset)
+	if err != nil {
+		return fmt.Errorf("failed to create footer: %w", err)
+	}
+	if _, err := f.counter().Write(footer); err != nil {
+		return fmt.Errorf("failed to write footer: %w", err)
+	}
+	return nil
+}
+
+// writerFunc turns a function into an io.Writer.
+type writerFunc func(p []byte) (int, error)
+
+// Write calls the function.
+func (w writerFunc) Write(p []byte) (int, error) {
+	return w(p)
+}
+
+// nextFrame finishes the current tar entry and starts a new frame. Returns
+// the offset of the new frame.
+func nextFrame(twriter *tar.Writer, splitter *frameSplitter) (int64, error) {
+	if err := twriter.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to flush tar entry: %w", err)
+	}
+	return splitter.next()
+}
+
+// writeTOC writes the table of contents as the last tar entry, closes the
+// tar stream and writes the footer pointing to the table of contents. The
+// table of contents is not written if the codec does not use footers.
+func writeTOC(toc *TOC, twriter *tar.Writer, splitter *frameSplitter) error {
+	if splitter.codec.footer == nil {
+		if err := twriter.Close(); err != nil {
+			return fmt.Errorf("failed to close tar: %w", err)
+		}
+		return splitter.Close(0)
+	}
+	data, err := json.Marshal(toc)
+	if err != nil {
+		return fmt.Errorf("failed to encode toc: %w", err)
+	}
+	offset, err := nextFrame(twriter, splitter)
+	if err != nil {
+		return err
+	}
+	if err := twriter.WriteHeader(&tar.Header{
+		Name:     TOCPath,
+		Typeflag: tar.TypeReg,
+		Mode:     0600,
+		Size:     int64(len(data)),
+	}); err != nil {
+		return fmt.Errorf("failed to write toc header: %w", err)
+	}
+	if _, err := twriter.Write(data); err != nil {
+		return fmt.Errorf("failed to write toc: %w", err)
+	}
+	if err := twriter.Close(); err != nil {
+		return fmt.Errorf("failed to close tar: %w", err)
+	}
+	return splitter.Close(offset)
+}
+
+// Archive gives random access to the files stored in a tarball written by
+// Compress or in an uncompressed tarball. Files can be read without
+// decompressing the whole tarball.
+type Archive struct {
+	file    *volumeSet
+	size    int64
+	codec   *Codec
+	toc     *TOC
+	entries map[string]TOCEntry
+	reached map[int64]string
+}
+
+// Open opens a tarball for random access. Returns ErrNotSeekable if the
+// tarball is compressed and does not carry a table of contents or if it is
+// encrypted (in which case ErrEncrypted is returned as well). Tarballs split
+// into volumes are opened as a whole, the checksums of the volumes are not
+// verified. Callers must close the returned Archive.
+func Open(source string) (*Archive, error) {
+	fp, err := openVolumes(source)
+	if err != nil {
+		return nil, err
+	}
+	breader := bufio.NewReader(fp)
+	if encrypted(breader) {
+		fp.Close()
+		return nil, fmt.Errorf("%w: %w", ErrNotSeekable, ErrEncrypted)
+	}
+	archive := &Archive{
+		file:    fp,
+		codec:   detect(breader),
+		entries: map[string]TOCEntry{},
+	}
+	archive.size = fp.size
+	readtoc := archive.readTOC
+	if archive.codec.footer == nil {
+		readtoc = archive.scanTOC
+	}
+	if err := readtoc(); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	for _, entry := range archive.toc.Entries {
+		archive.entries[entry.Name] = entry
+	}
+	return archive, nil
+}
+
+// readTOC locates the footer and reads the table of contents it points to.
+func (a *Archive) readTOC() error {
+	start := max(a.size-footerSearch, 0)
+	tail := make([]byte, a.size-start)
+	if _, err := a.file.ReadAt(tail, start); err != nil {
+		return fmt.Errorf("failed to read footer: %w", err)
+	}
+	offset, ok := a.codec.tocOffset(tail)
+	if !ok || offset >= a.size {
+		return ErrNotSeekable
+	}
+	stream, _, err := a.openAt(offset, TOCPath)
+	if err != nil {
+		return fmt.Errorf("failed to open toc: %w", err)
+	}
+	defer stream.Close()
+	var toc TOC
+	if err := json.NewDecoder(stream).Decode(&toc); err != nil {
+		return fmt.Errorf("failed to decode toc: %w", err)
+	}
+	if toc.Version > TOCVersion {
+		return fmt.Errorf("unsupported toc version %d", toc.Version)
+	}
+	a.toc = &toc
+	return nil
+}
+
+// scanTOC builds the table of contents of an uncompressed tarball by going
+// through all tar headers. Entries content is skipped, not read.
+func (a *Archive) scanTOC() error {
+	section := io.NewSectionReader(a.file, 0, a.size)
+	treader := tar.NewReader(section)
+	toc := &TOC{Version: TOCVersion}
+	var offset int64
+	for {
+		header, err := treader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return fmt.Errorf("failed to read tar header: %w", err)
+		}
+		position, err := section.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return fmt.Errorf("failed to get offset: %w", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			toc.Entries = append(
+				toc.Entries,
+				TOCEntry{Name: header.Name, Offset: offset, Size: header.Size},
+			)
+		}
+		offset = position + (header.Size+511)/512*512
+	}
+	a.toc = toc
+	return nil
+}
+
+// entryAt reads the header of the tar entry stored in the frame that starts
+// at offset. The returned entryReader reads the entry content and
+// must be closed by the caller.
+func (a *Archive) entryAt(offset int64) (*tar.Header, entryReader, error) {
+	section := io.NewSectionReader(a.file, offset, a.size-offset)
+	reader, err := a.codec.newReader(section)
+	if err != nil {
+		return nil, entryReader{}, fmt.Errorf("failed to create %s reader: %w", a.codec.name, err)
+	}
+	treader := tar.NewReader(reader)
+	header, err := treader.Next()
+	if err != nil {
+		reader.Close()
+		return nil, entryReader{}, fmt.Errorf("failed to read tar header: %w", err)
+	}
+	return header, entryReader{Reader: treader, Closer: reader}, nil
+}
+
+// openAt reads the tar entry stored in the frame starting at offset.
+// The entry must be named after name.
+func (a *Archive) openAt(offset int64, name string) (io.ReadCloser, int64, error) {
+	header, reader, err := a.entryAt(offset)
+	if err != nil {
+		return nil, -1, err
+	}
+	if header.Name != name {
+		reader.Close()
+		return nil, -1, fmt.Errorf("unexpected entry %s, expected %s", header.Name, name)
+	}
+	return reader, header.Size, nil
+}
+
+// entryReader reads a tar entry, closing releases the decompressor.
+type entryReader struct {
+	io.Reader
+	io.Closer
+}
+
+// Entries returns all files stored in the Archive.
+func (a *Archive) Entries() []TOCEntry {
+	return a.toc.Entries
+}
+
+// OpenFile returns a reader for the file with the provided name. Returns
+// an error satisfying os.IsNotExist if the file is not in the Archive.
+// Callers must close the returned reader. Concurrent calls are allowed.
+func (a *Archive) OpenFile(name string) (io.ReadCloser, int64, error) {
+	entry, ok := a.entries[name]
+	if !ok {
+		return nil, -1, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return a.openAt(entry.Offset, name)
+}
+
+// Extract writes the files stored in the Archive into the target directory,
+// following the same rules as Uncompress. Use WithFilter to extract only a
+// subset of the files. The table of contents is not trusted: the tarball is
+// read once sequentially, as Walk does, and entries whose frame is not where
+// the sequential read finds them, e.g. frames hidden after the end of the
+// tar stream, are refused so the files extracted are the ones any other
+// reader of the tarball sees.
+func (a *Archive) Extract(target string, opts ...Option) error {
+	extractor, err := newExtractor(target, opts...)
+	if err != nil {
+		return err
+	}
+	defer extractor.Close()
+	if a.reached == nil {
+		if a.reached, err = a.scanFrames(); err != nil {
+			return err
+		}
+	}
+	for _, entry := range a.toc.Entries {
+		if extractor.filter != nil && !extractor.filter(entry.Name) {
+			continue
+		}
+		if a.reached[entry.Offset] != entry.Name {
+			return fmt.Errorf("entry %s at offset %d not found reading the tarball", entry.Name, entry.Offset)
+		}
+		header, reader, err := a.entryAt(entry.Offset)
+		if err != nil {
+			return err
+		}
+		if header.Name != entry.Name {
+			reader.Close()
+			return fmt.Errorf("unexpected entry %s, expected %s", header.Name, entry.Name)
+		}
+		err = extractor.extract(header, reader)
+		reader.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanFrames reads the tarball sequentially and returns, keyed by the offset
+// of the frames they start at, the names of the regular files found. Frames
+// holding no tar header, as seen by a sequential reader, are left out.
+// Uncompressed tarballs are indexed sequentially already (see scanTOC).
+func (a *Archive) scanFrames() (map[int64]string, error) {
+	reached := map[int64]string{}
+	if a.codec.frameReader == nil {
+		for _, entry := range a.toc.Entries {
+			reached[entry.Offset] = entry.Name
+		}
+		return reached, nil
+	}
+	frames := &frameScanner{
+		codec:  a.codec,
+		src:    &countingReader{reader: bufio.NewReader(io.NewSectionReader(a.file, 0, a.size))},
+		starts: map[int64][]int64{},
+	}
+	defer frames.Close()
+	stream := &countingReader{reader: bufio.NewReader(frames)}
+	treader := tar.NewReader(stream)
+	var start int64
+	for {
+		header, err := treader.Next()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("failed to read tar header: %w", err)
+		}
+		if header.Typeflag == tar.TypeReg {
+			for _, offset := range frames.starts[start] {
+				reached[offset] = header.Name
+			}
+		}
+		if _, err := io.Copy(io.Discard, treader); err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", header.Name, err)
+		}
+		// the next header starts after the padding of the content.
+		start = stream.count + (512-header.Size%512)%512
+	}
+	return reached, nil
+}
+
+// countingReader reads from a bufio.Reader keeping track of the number of
+// bytes read. Decompressors reading from an io.ByteReader do not read past
+// the end of the compressed data.
+type countingReader struct {
+	reader *bufio.Reader
+	count  int64
+}
+
+// Read reads from the underlying reader.
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += int64(n)
+	return n, err
+}
+
+// ReadByte reads a single byte from the underlying reader.
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.reader.ReadByte()
+	if err == nil {
+		c.count++
+	}
+	return b, err
+}
+
+// frameScanner decompresses a tarball one frame at a time, returning the
+// frames content as a single stream. For each position of the stream it
+// records the offsets of the frames starting there (empty frames start
+// where the following one does).
+type frameScanner struct {
+	codec    *Codec
+	src      *countingReader
+	frame    io.ReadCloser
+	position int64
+	starts   map[int64][]int64
+}
+
+// Read reads from the current frame, moving to the next one when it ends.
+func (f *frameScanner) Read(p []byte) (int, error) {
+	for {
+		if f.frame == nil {
+			if _, err := f.src.reader.Peek(1); err != nil {
+				return 0, err
+			}
+			f.starts[f.position] = append(f.starts[f.position], f.src.count)
+			frame, err := f.codec.frameReader(f.src)
+			if err != nil {
+				return 0, fmt.Errorf("failed to create %s reader: %w", f.codec.name, err)
+			}
+			f.frame = frame
+		}
+		n, err := f.frame.Read(p)
+		f.position += int64(n)
+		if err == io.EOF {
+			f.frame.Close()
+			f.frame = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close releases the decompressor of the current frame.
+func (f *frameScanner) Close() error {
+	if f.frame == nil {
+		return nil
+	}
+	return f.frame.Close()
+}
+
+// Close closes the underlying tarball file.
+func (a *Archive) Close() error {
+	return a.file.Close()
+}
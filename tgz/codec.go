@@ -0,0 +1,357 @@
+package tgz
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// footerMagic prefixes the footer payload. It is followed by the offset, in
+// hexadecimal, of the frame holding the table of contents. The footer is
+// stored in a way regular decompressors ignore (an empty gzip member or a
+// zstd skippable frame).
+var footerMagic = []byte("TB\x10\x00")
+
+// footerSearch is the number of bytes, from the end of the file, in which we
+// look for the footer.
+const footerSearch = 512
+
+// zstdSkippableMagic is the magic number of a zstd skippable frame.
+var zstdSkippableMagic = []byte{0x50, 0x2a, 0x4d, 0x18}
+
+// Codec compresses and decompresses tarballs. Codecs able to concatenate
+// independent frames (gzip and zstd) write each tar entry into its own
+// frame and append a table of contents, so entries can later be read
+// without decompressing the whole tarball.
+type Codec struct {
+	name      string
+	magic     []byte
+	newWriter func(io.Writer) (frameWriter, error)
+	newReader func(io.Reader) (io.ReadCloser, error)
+	footer    func(offset int64) ([]byte, error)
+	tocOffset func(tail []byte) (int64, bool)
+	// frameReader decompresses a single frame, reading no further than
+	// its end from the provided reader (an io.ByteReader).
+	frameReader func(io.Reader) (io.ReadCloser, error)
+}
+
+// frameWriter writes a compressed frame. After Close a new frame can be
+// started with Reset.
+type frameWriter interface {
+	io.WriteCloser
+	Reset(w io.Writer)
+}
+
+var (
+	// Gzip compresses tarballs using gzip. This is the default codec.
+	Gzip = &Codec{
+		name:  "gzip",
+		magic: []byte{0x1f, 0x8b},
+		newWriter: func(w io.Writer) (frameWriter, error) {
+			return gzip.NewWriter(w), nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+		footer:    gzipFooter,
+		tocOffset: gzipTOCOffset,
+		frameReader: func(r io.Reader) (io.ReadCloser, error) {
+			reader, err := gzip.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			reader.Multistream(false)
+			return reader, nil
+		},
+	}
+	// Zstd compresses tarballs using zstandard.
+	Zstd = &Codec{
+		name:  "zstd",
+		magic: []byte{0x28, 0xb5, 0x2f, 0xfd},
+		newWriter: func(w io.Writer) (frameWriter, error) {
+			return zstd.NewWriter(w)
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(r)
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+		footer:    zstdFooter,
+		tocOffset: zstdTOCOffset,
+		frameReader: func(r io.Reader) (io.ReadCloser, error) {
+			decoder, err := zstd.NewReader(&zstdFrame{src: r})
+			if err != nil {
+				return nil, err
+			}
+			return decoder.IOReadCloser(), nil
+		},
+	}
+	// None does not compress tarballs. Entries in uncompressed tarballs
+	// can be located without a table of contents.
+	None = &Codec{
+		name: "none",
+		newWriter: func(w io.Writer) (frameWriter, error) {
+			return &passthrough{Writer: w}, nil
+		},
+		newReader: func(r io.Reader) (io.ReadCloser, error) {
+			return io.NopCloser(r), nil
+		},
+	}
+)
+
+// codecs holds all supported codecs. Codecs without magic must come last.
+var codecs = []*Codec{Gzip, Zstd, None}
+
+// CodecByName returns the codec with the provided name.
+func CodecByName(name string) (*Codec, error) {
+	for _, codec := range codecs {
+		if codec.name == name {
+			return codec, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown compression %q", name)
+}
+
+// Name returns the codec name.
+func (c *Codec) Name() string {
+	return c.name
+}
+
+// detect peeks at the beginning of the provided reader and returns the codec
+// used to compress it.
+func detect(reader *bufio.Reader) *Codec {
+	for _, codec := range codecs {
+		magic, err := reader.Peek(len(codec.magic))
+		if err == nil && bytes.Equal(magic, codec.magic) {
+			return codec
+		}
+	}
+	return None
+}
+
+// DetectCodec returns the codec the source tarball is compressed with.
+func DetectCodec(source string) (*Codec, error) {
+	fp, err := openVolumes(source)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	return detect(bufio.NewReader(fp)), nil
+}
+
+// passthrough is a frameWriter that does not compress.
+type passthrough struct {
+	io.Writer
+}
+
+// Close does nothing, there is nothing to flush.
+func (p *passthrough) Close() error {
+	return nil
+}
+
+// Reset starts writing to w.
+func (p *passthrough) Reset(w io.Writer) {
+	p.Writer = w
+}
+
+// gzipFooter returns an empty gzip member carrying the offset of the table
+// of contents in its extra field.
+func gzipFooter(offset int64) ([]byte, error) {
+	var buf bytes.Buffer
+	footer, err := gzip.NewWriterLevel(&buf, gzip.NoCompression)
+	if err != nil {
+		return nil, err
+	}
+	footer.Extra = append(
+		append([]byte{}, footerMagic...),
+		[]byte(fmt.Sprintf("%016x", offset))...,
+	)
+	if err := footer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipTOCOffset looks for a footer written by gzipFooter at the end of tail
+// and returns the offset it carries.
+func gzipTOCOffset(tail []byte) (int64, bool) {
+	idx := bytes.LastIndex(tail, []byte{0x1f, 0x8b, 0x08, 0x04})
+	if idx == -1 {
+		return 0, false
+	}
+	footer, err := gzip.NewReader(bytes.NewReader(tail[idx:]))
+	if err != nil || !bytes.HasPrefix(footer.Extra, footerMagic) {
+		return 0, false
+	}
+	return parseOffset(footer.Extra[len(footerMagic):])
+}
+
+// zstdFooter returns a zstd skippable frame carrying the offset of the table
+// of contents.
+func zstdFooter(offset int64) ([]byte, error) {
+	payload := append(
+		append([]byte{}, footerMagic...),
+		[]byte(fmt.Sprintf("%016x", offset))...,
+	)
+	footer := append([]byte{}, zstdSkippableMagic...)
+	footer = binary.LittleEndian.AppendUint32(footer, uint32(len(payload)))
+	return append(footer, payload...), nil
+}
+
+// zstdTOCOffset looks for a footer written by zstdFooter at the end of tail
+// and returns the offset it carries.
+func zstdTOCOffset(tail []byte) (int64, bool) {
+	size := len(zstdSkippableMagic) + 4 + len(footerMagic) + 16
+	if len(tail) < size {
+		return 0, false
+	}
+	footer := tail[len(tail)-size:]
+	if !bytes.HasPrefix(footer, zstdSkippableMagic) {
+		return 0, false
+	}
+	payload := footer[len(zstdSkippableMagic)+4:]
+	if !bytes.HasPrefix(payload, footerMagic) {
+		return 0, false
+	}
+	return parseOffset(payload[len(footerMagic):])
+}
+
+// zstd frame parsing states, see zstdFrame.
+const (
+	zstdFrameHeader = iota
+	zstdBlockHeader
+	zstdChecksum
+	zstdFrameEnd
+)
+
+// zstdFrame reads the compressed bytes of the zstd frame, regular or
+// skippable, src is positioned at. The frame end is found by parsing the
+// frame and block headers so nothing past it is read from src. Decoders
+// read ahead, reading through a zstdFrame stops them at the frame end.
+type zstdFrame struct {
+	src      io.Reader
+	state    int
+	checksum bool
+	pending  []byte
+	left     int64
+}
+
+// Read reads the frame bytes, returns io.EOF once the frame has been read.
+func (z *zstdFrame) Read(p []byte) (int, error) {
+	for len(z.pending) == 0 && z.left == 0 {
+		if z.state == zstdFrameEnd {
+			return 0, io.EOF
+		}
+		if err := z.advance(); err != nil {
+			return 0, err
+		}
+	}
+	if len(z.pending) > 0 {
+		n := copy(p, z.pending)
+		z.pending = z.pending[n:]
+		return n, nil
+	}
+	if int64(len(p)) > z.left {
+		p = p[:z.left]
+	}
+	n, err := z.src.Read(p)
+	z.left -= int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// advance parses the next header of the frame. Headers are returned by Read
+// before the content they describe.
+func (z *zstdFrame) advance() error {
+	switch z.state {
+	case zstdFrameHeader:
+		header, err := z.header(4)
+		if err != nil {
+			return err
+		}
+		magic := binary.LittleEndian.Uint32(header)
+		if magic&0xfffffff0 == binary.LittleEndian.Uint32(zstdSkippableMagic) {
+			size, err := z.header(4)
+			if err != nil {
+				return err
+			}
+			z.left = int64(binary.LittleEndian.Uint32(size))
+			z.state = zstdFrameEnd
+			return nil
+		}
+		if !bytes.Equal(header, Zstd.magic) {
+			return fmt.Errorf("invalid zstd frame magic %x", header)
+		}
+		descriptor, err := z.header(1)
+		if err != nil {
+			return err
+		}
+		// window descriptor, dictionary id and frame content size.
+		single := descriptor[0]&0x20 != 0
+		size := []int{0, 1, 2, 4}[descriptor[0]&0x03]
+		size += []int{0, 2, 4, 8}[descriptor[0]>>6]
+		if !single {
+			size++
+		} else if descriptor[0]>>6 == 0 {
+			size++
+		}
+		if _, err := z.header(size); err != nil {
+			return err
+		}
+		z.checksum = descriptor[0]&0x04 != 0
+		z.state = zstdBlockHeader
+	case zstdBlockHeader:
+		header, err := z.header(3)
+		if err != nil {
+			return err
+		}
+		block := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+		z.left = int64(block >> 3)
+		if (block>>1)&0x03 == 1 {
+			// rle blocks hold a single byte.
+			z.left = 1
+		}
+		if block&0x01 != 0 {
+			z.state = zstdChecksum
+		}
+	case zstdChecksum:
+		if z.checksum {
+			z.left = 4
+		}
+		z.state = zstdFrameEnd
+	}
+	return nil
+}
+
+// header reads size header bytes from src, they are returned by Read before
+// anything else.
+func (z *zstdFrame) header(size int) ([]byte, error) {
+	header := make([]byte, size)
+	if _, err := io.ReadFull(z.src, header); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("failed to read zstd frame: %w", err)
+	}
+	z.pending = append(z.pending, header...)
+	return header, nil
+}
+
+// parseOffset parses an hexadecimal offset.
+func parseOffset(hexoff []byte) (int64, bool) {
+	offset, err := strconv.ParseInt(string(hexoff), 16, 64)
+	if err != nil || offset < 0 {
+		return 0, false
+	}
+	return offset, true
+}
@@ -0,0 +1,70 @@
+package tgz
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"filippo.io/age"
+)
+
+// ageMagic prefixes the header of age encrypted files.
+var ageMagic = []byte("age-encryption.org/")
+
+// ErrEncrypted is returned when an encrypted tarball is read without any
+// identity to decrypt it. Encrypted tarballs can't be accessed at random
+// so Open also returns ErrNotSeekable for them.
+var ErrEncrypted = errors.New("tarball is encrypted")
+
+// WithEncryption makes Compress encrypt tarballs, using age, to the provided
+// recipients (X25519 public keys or a passphrase, see age.ScryptRecipient).
+// Encrypted tarballs can only be read sequentially.
+func WithEncryption(recipients ...age.Recipient) Option {
+	return func(o *options) {
+		o.recipients = recipients
+	}
+}
+
+// WithDecryption sets the identities used to decrypt encrypted tarballs read
+// by Walk and Uncompress. Unencrypted tarballs are read as usual.
+func WithDecryption(identities ...age.Identity) Option {
+	return func(o *options) {
+		o.identities = identities
+	}
+}
+
+// encrypted peeks at the beginning of the provided reader and returns true
+// if it holds an age encrypted file.
+func encrypted(reader *bufio.Reader) bool {
+	magic, err := reader.Peek(len(ageMagic))
+	return err == nil && bytes.Equal(magic, ageMagic)
+}
+
+// Encrypted returns true if the source tarball is encrypted.
+func Encrypted(source string) (bool, error) {
+	fp, err := openVolumes(source)
+	if err != nil {
+		return false, err
+	}
+	defer fp.Close()
+	return encrypted(bufio.NewReader(fp)), nil
+}
+
+// decrypt returns a reader for the plaintext of the provided reader. The
+// reader is returned as is if it is not encrypted. Decrypted content is
+// authenticated as it is read, tampering is reported by the reader.
+func decrypt(reader *bufio.Reader, identities []age.Identity) (io.Reader, error) {
+	if !encrypted(reader) {
+		return reader, nil
+	}
+	if len(identities) == 0 {
+		return nil, ErrEncrypted
+	}
+	plain, err := age.Decrypt(reader, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt tarball: %w", err)
+	}
+	return plain, nil
+}
@@ -2,67 +2,267 @@ package tgz
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"bufio"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+
+	"filippo.io/age"
+)
+
+// DefaultMaxSize is the default maximum number of bytes Uncompress writes
+// to disk. Tarballs expanding to more than this are refused.
+const DefaultMaxSize = 1 << 40
+
+var (
+	// ErrUnsafePath is returned when an entry would be written outside of
+	// the target directory.
+	ErrUnsafePath = errors.New("entry escapes target directory")
+	// ErrUnsupportedEntry is returned when an entry is not a regular file
+	// nor a directory (links, devices, fifos, etc).
+	ErrUnsupportedEntry = errors.New("unsupported entry type")
+	// ErrSizeLimit is returned when the extracted content exceeds the
+	// maximum allowed size.
+	ErrSizeLimit = errors.New("extracted size exceeds limit")
 )
 
-// Uncompress uncompresses source tgz into target directory.
-func Uncompress(source, target string) error {
-	fp, err := os.Open(source)
+// EntryError is returned when a tarball entry can not be extracted. Err is
+// one of ErrUnsafePath, ErrUnsupportedEntry or ErrSizeLimit.
+type EntryError struct {
+	Name string
+	Err  error
+}
+
+// Error returns the error message, including the offending entry name.
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
+// Option is a functional option for Compress, Uncompress and Extract.
+type Option func(*options)
+
+// options holds the compression and extraction configuration.
+type options struct {
+	maxsize    int64
+	filter     func(name string) bool
+	codec      *Codec
+	recipients []age.Recipient
+	identities []age.Identity
+	splitsize  int64
+}
+
+// WithCodec sets the codec used to compress tarballs.
+func WithCodec(codec *Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithMaxSize sets the maximum number of bytes to be written to disk.
+// A size of zero disables the limit.
+func WithMaxSize(size int64) Option {
+	return func(o *options) {
+		o.maxsize = size
+	}
+}
+
+// WithFilter sets a function to select which entries are extracted. Only
+// entries for which the function returns true are written to disk. When
+// compressing it selects which files are archived, directories for which
+// it returns false are skipped along with their content.
+func WithFilter(filter func(name string) bool) Option {
+	return func(o *options) {
+		o.filter = filter
+	}
+}
+
+// WalkFunc is called for each entry found in a tarball. Content reads the
+// entry data and is only valid until the function returns.
+type WalkFunc func(header *tar.Header, content io.Reader) error
+
+// Walk streams through the source tarball calling fn for each entry found.
+// The compression is detected automatically. Nothing is written to disk.
+// Encrypted tarballs are decrypted with the identities set through
+// WithDecryption, ErrEncrypted is returned if none has been set. Tarballs
+// split into volumes are reassembled, the checksum of each volume being
+// verified as it is read.
+func Walk(source string, fn WalkFunc, opts ...Option) error {
+	var options options
+	for _, opt := range opts {
+		opt(&options)
+	}
+	volumes, err := openVolumes(source)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return err
 	}
-	defer fp.Close()
-	gzreader, err := gzip.NewReader(fp)
+	defer volumes.Close()
+	plain, err := decrypt(bufio.NewReader(volumes), options.identities)
 	if err != nil {
-		return fmt.Errorf("failed to create gzip reader: %w", err)
+		return err
 	}
-	defer gzreader.Close()
-	treader := tar.NewReader(gzreader)
+	breader := bufio.NewReader(plain)
+	codec := detect(breader)
+	reader, err := codec.newReader(breader)
+	if err != nil {
+		return fmt.Errorf("failed to create %s reader: %w", codec.name, err)
+	}
+	defer reader.Close()
+	treader := tar.NewReader(reader)
+	content := &errorRecorder{Reader: treader}
 	for {
 		header, err := treader.Next()
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return fmt.Errorf("failed to read tar header: %w", err)
+			return volumes.diagnose(fmt.Errorf("failed to read tar header: %w", err))
 		}
-		path := filepath.Join(target, header.Name)
-		info := header.FileInfo()
-		if info.IsDir() {
-			if err := os.MkdirAll(path, info.Mode()); err != nil {
-				return fmt.Errorf("failed to create dir: %w", err)
+		if err := fn(header, content); err != nil {
+			if content.err != nil {
+				return volumes.diagnose(err)
 			}
-			continue
-		}
-		perm := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
-		file, err := os.OpenFile(path, perm, info.Mode())
-		if err != nil {
-			return fmt.Errorf("failed to open file: %w", err)
-		}
-		if _, err = io.Copy(file, treader); err != nil {
-			file.Close()
 			return err
 		}
-		file.Close()
+	}
+	// whatever follows the tar stream (e.g. the footer) is read so the
+	// checksum of the last volume is verified.
+	if _, err := io.Copy(io.Discard, volumes); err != nil {
+		return fmt.Errorf("failed to read tarball: %w", err)
+	}
+	return nil
+}
+
+// Uncompress uncompresses source tarball into target directory. Entries are
+// never written outside of the target directory, only regular files and
+// directories are accepted and the total extracted size is capped (see
+// DefaultMaxSize and WithMaxSize). Offending entries are reported through
+// an *EntryError.
+func Uncompress(source, target string, opts ...Option) error {
+	extractor, err := newExtractor(target, opts...)
+	if err != nil {
+		return err
+	}
+	defer extractor.Close()
+	return Walk(source, extractor.extract, opts...)
+}
+
+// extractor writes tar entries into a target directory. See Uncompress for
+// the rules enforced on each entry.
+type extractor struct {
+	options
+	root  *os.Root
+	total int64
+}
+
+// newExtractor returns an extractor writing into the provided directory.
+// Callers must close the returned extractor.
+func newExtractor(target string, opts ...Option) (*extractor, error) {
+	root, err := os.OpenRoot(target)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open target dir: %w", err)
+	}
+	ext := &extractor{
+		options: options{maxsize: DefaultMaxSize},
+		root:    root,
+	}
+	for _, opt := range opts {
+		opt(&ext.options)
+	}
+	return ext, nil
+}
+
+// Close releases the target directory.
+func (e *extractor) Close() error {
+	return e.root.Close()
+}
+
+// extract writes a single entry into the target directory. This function
+// is meant to be used as a WalkFunc.
+func (e *extractor) extract(header *tar.Header, content io.Reader) error {
+	name := filepath.Clean(filepath.FromSlash(header.Name))
+	if !filepath.IsLocal(name) {
+		return &EntryError{Name: header.Name, Err: ErrUnsafePath}
+	}
+	if e.filter != nil && !e.filter(filepath.ToSlash(name)) {
+		return nil
+	}
+	perm := header.FileInfo().Mode().Perm()
+	switch header.Typeflag {
+	case tar.TypeXGlobalHeader:
+		return nil
+	case tar.TypeDir:
+		if err := e.root.MkdirAll(name, perm|0700); err != nil {
+			return fmt.Errorf("failed to create dir: %w", err)
+		}
+		return nil
+	case tar.TypeReg:
+	default:
+		return &EntryError{Name: header.Name, Err: ErrUnsupportedEntry}
+	}
+	if e.total += header.Size; e.maxsize > 0 && e.total > e.maxsize {
+		return &EntryError{Name: header.Name, Err: ErrSizeLimit}
+	}
+	if err := e.root.MkdirAll(filepath.Dir(name), 0700); err != nil {
+		return fmt.Errorf("failed to create dir: %w", err)
+	}
+	flags := os.O_CREATE | os.O_TRUNC | os.O_WRONLY
+	file, err := e.root.OpenFile(name, flags, perm|0600)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+	if _, err = io.Copy(file, content); err != nil {
+		return err
 	}
 	return nil
 }
 
-// Compress creates a tar.gz file at target containing the contents of source.
-func Compress(source, target string) error {
-	tfile, err := os.Create(target)
+// Compress creates a compressed tarball at target containing the contents
+// of source. Gzip is used unless a different codec is set with WithCodec.
+// Each entry is written into its own compressed frame and a table of
+// contents is appended to the end of the file. The result is a regular
+// compressed tarball that can also be read entry by entry (see Open)
+// without decompressing it entirely. If recipients are set through
+// WithEncryption the compressed tarball is encrypted to them. If a split
+// size is set through WithSplitSize the tarball is split into volumes. Only
+// files selected by the filter set through WithFilter, if any, are archived.
+func Compress(source, target string, opts ...Option) error {
+	options := options{codec: Gzip}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	var tfile io.WriteCloser
+	var volumes *volumeWriter
+	var err error
+	if options.splitsize > 0 {
+		volumes, err = newVolumeWriter(target, options.splitsize)
+		tfile = volumes
+	} else {
+		tfile, err = os.Create(target)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to create tar file: %w", err)
 	}
 	defer tfile.Close()
-	gzwriter := gzip.NewWriter(tfile)
-	defer gzwriter.Close()
-	twriter := tar.NewWriter(gzwriter)
-	defer twriter.Close()
+	var output io.WriteCloser = tfile
+	if len(options.recipients) > 0 {
+		if output, err = age.Encrypt(tfile, options.recipients...); err != nil {
+			return fmt.Errorf("failed to encrypt tar file: %w", err)
+		}
+	}
+	splitter, err := newFrameSplitter(output, options.codec)
+	if err != nil {
+		return err
+	}
+	twriter := tar.NewWriter(splitter)
+	toc := &TOC{Version: TOCVersion}
 	walker := func(file string, fi os.FileInfo, err error) error {
 		if err != nil {
 			return err
@@ -71,16 +271,34 @@ func Compress(source, target string) error {
 		if err != nil {
 			return fmt.Errorf("failed to create header: %w", err)
 		}
-		header.Name, err = filepath.Rel(source, file)
+		relpath, err := filepath.Rel(source, file)
 		if err != nil {
 			return fmt.Errorf("failed to get relative path: %w", err)
 		}
+		header.Name = filepath.ToSlash(relpath)
+		if header.Name == TOCPath {
+			return nil
+		}
+		if options.filter != nil && !options.filter(header.Name) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		offset, err := nextFrame(twriter, splitter)
+		if err != nil {
+			return err
+		}
 		if err := twriter.WriteHeader(header); err != nil {
 			return fmt.Errorf("failed to write header: %w", err)
 		}
 		if fi.Mode().IsDir() {
 			return nil
 		}
+		toc.Entries = append(
+			toc.Entries,
+			TOCEntry{Name: header.Name, Offset: offset, Size: fi.Size()},
+		)
 		fp, err := os.Open(file)
 		if err != nil {
 			return fmt.Errorf("failed to open file: %w", err)
@@ -91,5 +309,35 @@ func Compress(source, target string) error {
 		}
 		return nil
 	}
-	return filepath.Walk(source, walker)
+	if err := filepath.Walk(source, walker); err != nil {
+		return err
+	}
+	if err := writeTOC(toc, twriter, splitter); err != nil {
+		return err
+	}
+	if output != tfile {
+		if err := output.Close(); err != nil {
+			return fmt.Errorf("failed to encrypt tar file: %w", err)
+		}
+	}
+	if volumes != nil {
+		return volumes.Commit()
+	}
+	return tfile.Close()
+}
+
+// errorRecorder records the last error, other than io.EOF, returned by the
+// wrapped reader.
+type errorRecorder struct {
+	io.Reader
+	err error
+}
+
+// Read reads from the wrapped reader.
+func (e *errorRecorder) Read(p []byte) (int, error) {
+	n, err := e.Reader.Read(p)
+	if err != nil && err != io.EOF {
+		e.err = err
+	}
+	return n, err
 }
@@ -0,0 +1,569 @@
+package tgz
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+// writeTgz writes a tgz file containing the provided headers. Regular files
+// are filled with header.Size bytes.
+func writeTgz(t *testing.T, fpath string, headers ...*tar.Header) {
+	fp, err := os.Create(fpath)
+	assert.NoError(t, err)
+	defer fp.Close()
+	gzwriter := gzip.NewWriter(fp)
+	defer gzwriter.Close()
+	twriter := tar.NewWriter(gzwriter)
+	defer twriter.Close()
+	for _, header := range headers {
+		err := twriter.WriteHeader(header)
+		assert.NoError(t, err)
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		_, err = twriter.Write(make([]byte, header.Size))
+		assert.NoError(t, err)
+	}
+}
+
+func TestCompressUncompress(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	srcdir := path.Join(tmpdir, "src")
+	err = os.MkdirAll(path.Join(srcdir, "img", "nested"), 0700)
+	assert.NoError(t, err)
+	err = os.WriteFile(path.Join(srcdir, "img", "nested", "file"), []byte("data"), 0600)
+	assert.NoError(t, err)
+	tgzpath := path.Join(tmpdir, "file.tgz")
+	err = Compress(srcdir, tgzpath)
+	assert.NoError(t, err)
+	encrypted, err := Encrypted(tgzpath)
+	assert.NoError(t, err)
+	assert.False(t, encrypted)
+	dstdir := path.Join(tmpdir, "dst")
+	err = os.Mkdir(dstdir, 0700)
+	assert.NoError(t, err)
+	err = Uncompress(tgzpath, dstdir)
+	assert.NoError(t, err)
+	data, err := os.ReadFile(path.Join(dstdir, "img", "nested", "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, "data", string(data))
+}
+
+func TestCompressFilter(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	srcdir := path.Join(tmpdir, "src")
+	for _, dir := range []string{"keep", "skip"} {
+		err = os.MkdirAll(path.Join(srcdir, dir), 0700)
+		assert.NoError(t, err)
+		err = os.WriteFile(path.Join(srcdir, dir, "file"), []byte(dir), 0600)
+		assert.NoError(t, err)
+	}
+	tgzpath := path.Join(tmpdir, "file.tgz")
+	err = Compress(srcdir, tgzpath, WithFilter(func(name string) bool {
+		return name != "skip"
+	}))
+	assert.NoError(t, err)
+	var names []string
+	err = Walk(tgzpath, func(header *tar.Header, _ io.Reader) error {
+		names = append(names, header.Name)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{".", "keep", "keep/file", TOCPath}, names)
+}
+
+func TestUncompressRejects(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		headers []*tar.Header
+		opts    []Option
+		err     error
+	}{
+		{
+			name: "parent directory",
+			headers: []*tar.Header{
+				{Name: "../escape", Typeflag: tar.TypeReg, Mode: 0600, Size: 1},
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "nested parent directory",
+			headers: []*tar.Header{
+				{Name: "img/../../escape", Typeflag: tar.TypeReg, Mode: 0600, Size: 1},
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "absolute path",
+			headers: []*tar.Header{
+				{Name: "/tmp/escape", Typeflag: tar.TypeReg, Mode: 0600, Size: 1},
+			},
+			err: ErrUnsafePath,
+		},
+		{
+			name: "symlink",
+			headers: []*tar.Header{
+				{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"},
+			},
+			err: ErrUnsupportedEntry,
+		},
+		{
+			name: "hardlink",
+			headers: []*tar.Header{
+				{Name: "link", Typeflag: tar.TypeLink, Linkname: "/etc/passwd"},
+			},
+			err: ErrUnsupportedEntry,
+		},
+		{
+			name: "size limit",
+			headers: []*tar.Header{
+				{Name: "file0", Typeflag: tar.TypeReg, Mode: 0600, Size: 6},
+				{Name: "file1", Typeflag: tar.TypeReg, Mode: 0600, Size: 6},
+			},
+			opts: []Option{WithMaxSize(10)},
+			err:  ErrSizeLimit,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpdir, err := os.MkdirTemp("", "")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmpdir)
+			tgzpath := path.Join(tmpdir, "file.tgz")
+			writeTgz(t, tgzpath, tt.headers...)
+			dstdir := path.Join(tmpdir, "dst")
+			err = os.Mkdir(dstdir, 0700)
+			assert.NoError(t, err)
+			err = Uncompress(tgzpath, dstdir, tt.opts...)
+			assert.ErrorIs(t, err, tt.err)
+			var entryErr *EntryError
+			assert.ErrorAs(t, err, &entryErr)
+			_, err = os.Stat(path.Join(tmpdir, "escape"))
+			assert.True(t, os.IsNotExist(err))
+		})
+	}
+}
+
+func TestArchive(t *testing.T) {
+	for _, codec := range []*Codec{Gzip, Zstd, None} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			testArchive(t, codec)
+		})
+	}
+}
+
+func testArchive(t *testing.T, codec *Codec) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	srcdir := path.Join(tmpdir, "src")
+	files := map[string]string{
+		"img0/manifest.json": "manifest0",
+		"img0/blob":          "blob0",
+		"img1/manifest.json": "manifest1",
+	}
+	for name, content := range files {
+		err := os.MkdirAll(path.Join(srcdir, path.Dir(name)), 0700)
+		assert.NoError(t, err)
+		err = os.WriteFile(path.Join(srcdir, name), []byte(content), 0600)
+		assert.NoError(t, err)
+	}
+	tgzpath := path.Join(tmpdir, "file.tgz")
+	err = Compress(srcdir, tgzpath, WithCodec(codec))
+	assert.NoError(t, err)
+
+	walked := map[string]bool{}
+	err = Walk(tgzpath, func(header *tar.Header, _ io.Reader) error {
+		walked[header.Name] = true
+		return nil
+	})
+	assert.NoError(t, err)
+	for name := range files {
+		assert.True(t, walked[name])
+	}
+
+	archive, err := Open(tgzpath)
+	assert.NoError(t, err)
+	defer archive.Close()
+	assert.Len(t, archive.Entries(), len(files))
+	for name, content := range files {
+		stream, size, err := archive.OpenFile(name)
+		assert.NoError(t, err)
+		data, err := io.ReadAll(stream)
+		assert.NoError(t, err)
+		stream.Close()
+		assert.Equal(t, int64(len(content)), size)
+		assert.Equal(t, content, string(data))
+	}
+	_, _, err = archive.OpenFile("img2/manifest.json")
+	assert.True(t, os.IsNotExist(err))
+
+	dstdir := path.Join(tmpdir, "dst")
+	err = os.Mkdir(dstdir, 0700)
+	assert.NoError(t, err)
+	err = archive.Extract(dstdir, WithFilter(func(name string) bool {
+		return path.Base(name) == "manifest.json"
+	}))
+	assert.NoError(t, err)
+	_, err = os.Stat(path.Join(dstdir, "img1", "manifest.json"))
+	assert.NoError(t, err)
+	_, err = os.Stat(path.Join(dstdir, "img0", "blob"))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestArchiveForged(t *testing.T) {
+	for _, codec := range []*Codec{Gzip, Zstd} {
+		t.Run(codec.Name(), func(t *testing.T) {
+			testArchiveForged(t, codec)
+		})
+	}
+}
+
+// testArchiveForged appends, after the end of the tar stream, frames only
+// reachable through a forged table of contents and checks Extract refuses
+// them while readers going through the tarball sequentially ignore them.
+func testArchiveForged(t *testing.T, codec *Codec) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	srcdir := path.Join(tmpdir, "src")
+	err = os.MkdirAll(path.Join(srcdir, "img"), 0700)
+	assert.NoError(t, err)
+	err = os.WriteFile(path.Join(srcdir, "img", "manifest.json"), []byte("manifest"), 0600)
+	assert.NoError(t, err)
+	// large enough to span multiple compressed blocks.
+	blob := make([]byte, 1<<20)
+	_, err = rand.Read(blob)
+	assert.NoError(t, err)
+	err = os.WriteFile(path.Join(srcdir, "img", "blob"), blob, 0600)
+	assert.NoError(t, err)
+	tgzpath := path.Join(tmpdir, "file.tgz")
+	err = Compress(srcdir, tgzpath, WithCodec(codec))
+	assert.NoError(t, err)
+	archive, err := Open(tgzpath)
+	assert.NoError(t, err)
+	original := archive.Entries()
+	assert.NoError(t, archive.Close())
+
+	// frame writes a single frame holding a tar entry, without the tar
+	// end marker unless last is set.
+	frame := func(out *bytes.Buffer, name string, content []byte, last bool) int64 {
+		offset := int64(out.Len())
+		writer, err := codec.newWriter(out)
+		assert.NoError(t, err)
+		twriter := tar.NewWriter(writer)
+		err = twriter.WriteHeader(&tar.Header{
+			Name:     name,
+			Typeflag: tar.TypeReg,
+			Mode:     0600,
+			Size:     int64(len(content)),
+		})
+		assert.NoError(t, err)
+		_, err = twriter.Write(content)
+		assert.NoError(t, err)
+		if last {
+			assert.NoError(t, twriter.Close())
+		} else {
+			assert.NoError(t, twriter.Flush())
+		}
+		assert.NoError(t, writer.Close())
+		return offset
+	}
+	forge := func(entries func(hidden int64) []TOCEntry) string {
+		data, err := os.ReadFile(tgzpath)
+		assert.NoError(t, err)
+		footer, err := codec.footer(0)
+		assert.NoError(t, err)
+		out := bytes.NewBuffer(data[:len(data)-len(footer)])
+		hidden := frame(out, "img/manifest.json", []byte("forged"), false)
+		toc, err := json.Marshal(TOC{Version: TOCVersion, Entries: entries(hidden)})
+		assert.NoError(t, err)
+		offset := frame(out, TOCPath, toc, true)
+		footer, err = codec.footer(offset)
+		assert.NoError(t, err)
+		out.Write(footer)
+		forged := path.Join(tmpdir, "forged.tgz")
+		assert.NoError(t, os.WriteFile(forged, out.Bytes(), 0600))
+		return forged
+	}
+
+	for _, tt := range []struct {
+		name    string
+		entries func(hidden int64) []TOCEntry
+		err     string
+	}{
+		{
+			name: "original entries",
+			entries: func(int64) []TOCEntry {
+				return original
+			},
+		},
+		{
+			name: "hidden frame",
+			entries: func(hidden int64) []TOCEntry {
+				return []TOCEntry{{Name: "img/manifest.json", Offset: hidden, Size: 6}}
+			},
+			err: "entry img/manifest.json at offset",
+		},
+		{
+			name: "renamed entry",
+			entries: func(int64) []TOCEntry {
+				entries := append([]TOCEntry{}, original...)
+				for i := range entries {
+					entries[i].Name = "img/" + path.Base(entries[i].Name) + ".renamed"
+				}
+				return entries
+			},
+			err: "not found reading the tarball",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			forged := forge(tt.entries)
+			var manifests []string
+			err := Walk(forged, func(header *tar.Header, content io.Reader) error {
+				if header.Name != "img/manifest.json" {
+					return nil
+				}
+				data, err := io.ReadAll(content)
+				manifests = append(manifests, string(data))
+				return err
+			})
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"manifest"}, manifests)
+
+			archive, err := Open(forged)
+			assert.NoError(t, err)
+			defer archive.Close()
+			dstdir, err := os.MkdirTemp(tmpdir, "")
+			assert.NoError(t, err)
+			err = archive.Extract(dstdir)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			assert.NoError(t, err)
+			data, err := os.ReadFile(path.Join(dstdir, "img", "manifest.json"))
+			assert.NoError(t, err)
+			assert.Equal(t, "manifest", string(data))
+			data, err = os.ReadFile(path.Join(dstdir, "img", "blob"))
+			assert.NoError(t, err)
+			assert.Equal(t, blob, data)
+		})
+	}
+}
+
+func TestOpenNotSeekable(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	tgzpath := path.Join(tmpdir, "file.tgz")
+	writeTgz(t, tgzpath, &tar.Header{Name: "file", Typeflag: tar.TypeReg, Mode: 0600, Size: 1})
+	_, err = Open(tgzpath)
+	assert.ErrorIs(t, err, ErrNotSeekable)
+}
+
+func TestCodecByName(t *testing.T) {
+	for _, name := range []string{"gzip", "zstd", "none"} {
+		codec, err := CodecByName(name)
+		assert.NoError(t, err)
+		assert.Equal(t, name, codec.Name())
+	}
+	_, err := CodecByName("bzip2")
+	assert.Error(t, err)
+}
+
+func TestDetectCodec(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	srcdir := path.Join(tmpdir, "src")
+	err = os.Mkdir(srcdir, 0700)
+	assert.NoError(t, err)
+	err = os.WriteFile(path.Join(srcdir, "file"), []byte("data"), 0600)
+	assert.NoError(t, err)
+	for _, codec := range []*Codec{Gzip, Zstd, None} {
+		tgzpath := path.Join(tmpdir, codec.Name())
+		err = Compress(srcdir, tgzpath, WithCodec(codec))
+		assert.NoError(t, err)
+		detected, err := DetectCodec(tgzpath)
+		assert.NoError(t, err)
+		assert.Equal(t, codec.Name(), detected.Name())
+	}
+	_, err = DetectCodec(path.Join(tmpdir, "missing"))
+	assert.Error(t, err)
+}
+
+func TestEncryption(t *testing.T) {
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	scrypt, err := age.NewScryptRecipient("passphrase")
+	assert.NoError(t, err)
+	scrypt.SetWorkFactor(10)
+	passphrase, err := age.NewScryptIdentity("passphrase")
+	assert.NoError(t, err)
+	for name, tt := range map[string]struct {
+		recipient age.Recipient
+		identity  age.Identity
+	}{
+		"x25519":     {recipient: identity.Recipient(), identity: identity},
+		"passphrase": {recipient: scrypt, identity: passphrase},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmpdir, err := os.MkdirTemp("", "")
+			assert.NoError(t, err)
+			defer os.RemoveAll(tmpdir)
+			srcdir := path.Join(tmpdir, "src")
+			err = os.Mkdir(srcdir, 0700)
+			assert.NoError(t, err)
+			err = os.WriteFile(path.Join(srcdir, "file"), []byte("data"), 0600)
+			assert.NoError(t, err)
+			tgzpath := path.Join(tmpdir, "file.tgz.age")
+			err = Compress(srcdir, tgzpath, WithEncryption(tt.recipient))
+			assert.NoError(t, err)
+			encrypted, err := Encrypted(tgzpath)
+			assert.NoError(t, err)
+			assert.True(t, encrypted)
+
+			_, err = Open(tgzpath)
+			assert.ErrorIs(t, err, ErrNotSeekable)
+			assert.ErrorIs(t, err, ErrEncrypted)
+			dstdir := path.Join(tmpdir, "dst")
+			err = os.Mkdir(dstdir, 0700)
+			assert.NoError(t, err)
+			err = Uncompress(tgzpath, dstdir)
+			assert.ErrorIs(t, err, ErrEncrypted)
+
+			err = Uncompress(tgzpath, dstdir, WithDecryption(tt.identity))
+			assert.NoError(t, err)
+			data, err := os.ReadFile(path.Join(dstdir, "file"))
+			assert.NoError(t, err)
+			assert.Equal(t, "data", string(data))
+		})
+	}
+}
+
+func TestDecryptionWrongIdentity(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	srcdir := path.Join(tmpdir, "src")
+	err = os.Mkdir(srcdir, 0700)
+	assert.NoError(t, err)
+	err = os.WriteFile(path.Join(srcdir, "file"), []byte("data"), 0600)
+	assert.NoError(t, err)
+	identity, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	other, err := age.GenerateX25519Identity()
+	assert.NoError(t, err)
+	tgzpath := path.Join(tmpdir, "file.tgz.age")
+	err = Compress(srcdir, tgzpath, WithEncryption(identity.Recipient()))
+	assert.NoError(t, err)
+	err = Walk(tgzpath, func(*tar.Header, io.Reader) error { return nil }, WithDecryption(other))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, ErrEncrypted)
+}
+
+func TestSplitVolumes(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	srcdir := path.Join(tmpdir, "src")
+	err = os.Mkdir(srcdir, 0700)
+	assert.NoError(t, err)
+	content := make([]byte, 4096)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	err = os.WriteFile(path.Join(srcdir, "file"), content, 0600)
+	assert.NoError(t, err)
+	tgzpath := path.Join(tmpdir, "file.tgz")
+	err = Compress(srcdir, tgzpath, WithCodec(None), WithSplitSize(1000))
+	assert.NoError(t, err)
+	_, err = os.Stat(tgzpath)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(tgzpath + VolumesSuffix)
+	assert.NoError(t, err)
+	_, err = os.Stat(volumePath(tgzpath, 5))
+	assert.NoError(t, err)
+
+	dstdir := path.Join(tmpdir, "dst")
+	err = os.Mkdir(dstdir, 0700)
+	assert.NoError(t, err)
+	err = Uncompress(tgzpath, dstdir)
+	assert.NoError(t, err)
+	data, err := os.ReadFile(path.Join(dstdir, "file"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	archive, err := Open(tgzpath)
+	assert.NoError(t, err)
+	reader, _, err := archive.OpenFile("file")
+	assert.NoError(t, err)
+	data, err = io.ReadAll(reader)
+	assert.NoError(t, err)
+	assert.Equal(t, content, data)
+	reader.Close()
+	archive.Close()
+
+	// same size, different content.
+	volume := volumePath(tgzpath, 3)
+	data, err = os.ReadFile(volume)
+	assert.NoError(t, err)
+	data[0] ^= 0xff
+	err = os.WriteFile(volume, data, 0600)
+	assert.NoError(t, err)
+	err = Walk(tgzpath, func(*tar.Header, io.Reader) error { return nil })
+	assert.ErrorIs(t, err, ErrCorruptVolume)
+	assert.ErrorContains(t, err, "file.tgz.003")
+
+	err = os.Remove(volume)
+	assert.NoError(t, err)
+	err = Walk(tgzpath, func(*tar.Header, io.Reader) error { return nil })
+	assert.ErrorIs(t, err, ErrMissingVolume)
+	assert.ErrorContains(t, err, "file.tgz.003")
+}
+
+func TestSplitVolumesCodecs(t *testing.T) {
+	tmpdir, err := os.MkdirTemp("", "")
+	assert.NoError(t, err)
+	defer os.RemoveAll(tmpdir)
+	srcdir := path.Join(tmpdir, "src")
+	err = os.MkdirAll(path.Join(srcdir, "img"), 0700)
+	assert.NoError(t, err)
+	for _, name := range []string{"a", "b", "c"} {
+		err = os.WriteFile(path.Join(srcdir, "img", name), []byte(name), 0600)
+		assert.NoError(t, err)
+	}
+	for _, codec := range []*Codec{Gzip, Zstd} {
+		tgzpath := path.Join(tmpdir, codec.Name())
+		err = Compress(srcdir, tgzpath, WithCodec(codec), WithSplitSize(64))
+		assert.NoError(t, err)
+		detected, err := DetectCodec(tgzpath)
+		assert.NoError(t, err)
+		assert.Equal(t, codec.Name(), detected.Name())
+		archive, err := Open(tgzpath)
+		assert.NoError(t, err)
+		for _, name := range []string{"a", "b", "c"} {
+			reader, _, err := archive.OpenFile("img/" + name)
+			assert.NoError(t, err)
+			data, err := io.ReadAll(reader)
+			assert.NoError(t, err)
+			assert.Equal(t, name, string(data))
+			reader.Close()
+		}
+		archive.Close()
+	}
+}
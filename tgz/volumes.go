@@ -0,0 +1,344 @@
+package tgz
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// VolumesSuffix is appended to the path of a tarball split into volumes
+// (see WithSplitSize) to obtain the path of its volume manifest.
+const VolumesSuffix = ".volumes"
+
+// VolumesVersion is the current version of the volume manifest format.
+const VolumesVersion = 1
+
+var (
+	// ErrMissingVolume is returned when a volume listed in the volume
+	// manifest can't be found.
+	ErrMissingVolume = errors.New("missing volume")
+	// ErrCorruptVolume is returned when the size or the checksum of a
+	// volume does not match the one recorded in the volume manifest.
+	ErrCorruptVolume = errors.New("corrupt volume")
+)
+
+// Volume describes one of the files a split tarball is made of. The name
+// is relative to the directory holding the volume manifest.
+type Volume struct {
+	Name   string        `json:"name"`
+	Size   int64         `json:"size"`
+	Digest digest.Digest `json:"digest"`
+}
+
+// Volumes is the manifest of a tarball split into volumes. Volumes are
+// listed in order, concatenating them gives back the tarball.
+type Volumes struct {
+	Version int      `json:"version"`
+	Volumes []Volume `json:"volumes"`
+}
+
+// WithSplitSize makes Compress split the tarball into volumes of at most
+// size bytes. Volumes are named after the target with a numeric suffix
+// (.001, .002, etc) and are listed, along with their sizes and checksums,
+// in a manifest written next to them (target plus VolumesSuffix). Walk,
+// Uncompress and Open read split tarballs given the target path.
+func WithSplitSize(size int64) Option {
+	return func(o *options) {
+		o.splitsize = size
+	}
+}
+
+// volumePath returns the path of the nth volume, starting at 1, of target.
+func volumePath(target string, n int) string {
+	return fmt.Sprintf("%s.%03d", target, n)
+}
+
+// volumeWriter writes a tarball split into volumes of at most size bytes.
+// The volume manifest is only written by Commit, a tarball whose writing
+// failed has no manifest and thus can't be read.
+type volumeWriter struct {
+	target   string
+	size     int64
+	file     *os.File
+	written  int64
+	digester digest.Digester
+	manifest Volumes
+}
+
+// newVolumeWriter returns a volumeWriter splitting the tarball written to
+// target into volumes of at most size bytes.
+func newVolumeWriter(target string, size int64) (*volumeWriter, error) {
+	if size <= 0 {
+		return nil, fmt.Errorf("invalid split size %d", size)
+	}
+	// an unsplit tarball takes precedence over the volumes when reading.
+	if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove %s: %w", target, err)
+	}
+	return &volumeWriter{
+		target:   target,
+		size:     size,
+		manifest: Volumes{Version: VolumesVersion},
+	}, nil
+}
+
+// next closes the current volume, if any, and starts the next one.
+func (v *volumeWriter) next() error {
+	if err := v.closeVolume(); err != nil {
+		return err
+	}
+	fpath := volumePath(v.target, len(v.manifest.Volumes)+1)
+	fp, err := os.Create(fpath)
+	if err != nil {
+		return fmt.Errorf("failed to create volume: %w", err)
+	}
+	v.file = fp
+	v.written = 0
+	v.digester = digest.Canonical.Digester()
+	return nil
+}
+
+// closeVolume closes the current volume and records it in the manifest.
+func (v *volumeWriter) closeVolume() error {
+	if v.file == nil {
+		return nil
+	}
+	fp := v.file
+	v.file = nil
+	if err := fp.Close(); err != nil {
+		return fmt.Errorf("failed to close volume: %w", err)
+	}
+	v.manifest.Volumes = append(v.manifest.Volumes, Volume{
+		Name:   filepath.Base(fp.Name()),
+		Size:   v.written,
+		Digest: v.digester.Digest(),
+	})
+	return nil
+}
+
+// Write writes p, starting new volumes as the current one fills up.
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	var total int
+	for len(p) > 0 {
+		if v.file == nil || v.written == v.size {
+			if err := v.next(); err != nil {
+				return total, err
+			}
+		}
+		chunk := p[:min(int64(len(p)), v.size-v.written)]
+		n, err := v.file.Write(chunk)
+		v.digester.Hash().Write(chunk[:n])
+		v.written += int64(n)
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to write volume: %w", err)
+		}
+		p = p[n:]
+	}
+	return total, nil
+}
+
+// Commit closes the last volume and writes the volume manifest.
+func (v *volumeWriter) Commit() error {
+	if v.file == nil && len(v.manifest.Volumes) == 0 {
+		if err := v.next(); err != nil {
+			return err
+		}
+	}
+	if err := v.closeVolume(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(v.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode volume manifest: %w", err)
+	}
+	if err := os.WriteFile(v.target+VolumesSuffix, data, 0644); err != nil {
+		return fmt.Errorf("failed to write volume manifest: %w", err)
+	}
+	return nil
+}
+
+// Close closes the current volume without writing the volume manifest.
+func (v *volumeWriter) Close() error {
+	if v.file == nil {
+		return nil
+	}
+	err := v.file.Close()
+	v.file = nil
+	return err
+}
+
+// volumeSet reads a tarball, either a single file or split into volumes,
+// as if it was a single file. Sequential reads verify the checksum of each
+// volume as its end is reached, random access reads do not.
+type volumeSet struct {
+	volumes  []Volume
+	files    []*os.File
+	offsets  []int64
+	size     int64
+	current  int
+	digester digest.Digester
+}
+
+// openVolumes opens the tarball stored in source. If source does not exist
+// but a volume manifest does the volumes listed in it are opened instead.
+// All volumes must exist and have the expected size. Callers must close the
+// returned volumeSet.
+func openVolumes(source string) (*volumeSet, error) {
+	fp, err := os.Open(source)
+	if err == nil {
+		info, err := fp.Stat()
+		if err != nil {
+			fp.Close()
+			return nil, fmt.Errorf("failed to stat file: %w", err)
+		}
+		set := &volumeSet{}
+		set.add(Volume{Name: source, Size: info.Size()}, fp)
+		return set, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+	data, merr := os.ReadFile(source + VolumesSuffix)
+	if merr != nil {
+		if os.IsNotExist(merr) {
+			return nil, fmt.Errorf("failed to open file: %w", err)
+		}
+		return nil, fmt.Errorf("failed to read volume manifest: %w", merr)
+	}
+	var manifest Volumes
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to decode volume manifest: %w", err)
+	}
+	if manifest.Version > VolumesVersion {
+		return nil, fmt.Errorf("unsupported volume manifest version %d", manifest.Version)
+	}
+	set := &volumeSet{}
+	var missing []string
+	var problems []error
+	for _, volume := range manifest.Volumes {
+		if volume.Name != filepath.Base(volume.Name) || volume.Name == ".." {
+			problems = append(problems, fmt.Errorf("invalid volume name %q", volume.Name))
+			continue
+		}
+		fp, err := os.Open(filepath.Join(filepath.Dir(source), volume.Name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				missing = append(missing, volume.Name)
+				continue
+			}
+			problems = append(problems, fmt.Errorf("failed to open volume: %w", err))
+			continue
+		}
+		info, err := fp.Stat()
+		if err != nil {
+			fp.Close()
+			problems = append(problems, fmt.Errorf("failed to stat volume: %w", err))
+			continue
+		}
+		if info.Size() != volume.Size {
+			fp.Close()
+			problems = append(problems, fmt.Errorf(
+				"%w: %s is %d bytes long, expected %d",
+				ErrCorruptVolume, volume.Name, info.Size(), volume.Size,
+			))
+			continue
+		}
+		set.add(volume, fp)
+	}
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Errorf("%w: %s", ErrMissingVolume, strings.Join(missing, ", ")))
+	}
+	if len(problems) > 0 {
+		set.Close()
+		return nil, errors.Join(problems...)
+	}
+	return set, nil
+}
+
+// add appends a volume to the set.
+func (s *volumeSet) add(volume Volume, fp *os.File) {
+	s.volumes = append(s.volumes, volume)
+	s.files = append(s.files, fp)
+	s.offsets = append(s.offsets, s.size)
+	s.size += volume.Size
+}
+
+// Read reads the volumes in order. Returns ErrCorruptVolume once the end
+// of a volume whose content does not match its checksum is reached.
+func (s *volumeSet) Read(p []byte) (int, error) {
+	for s.current < len(s.files) {
+		if s.digester == nil {
+			s.digester = digest.Canonical.Digester()
+		}
+		n, err := s.files[s.current].Read(p)
+		s.digester.Hash().Write(p[:n])
+		if err != io.EOF {
+			return n, err
+		}
+		volume := s.volumes[s.current]
+		if volume.Digest != "" && s.digester.Digest() != volume.Digest {
+			return n, fmt.Errorf("%w: %s checksum mismatch", ErrCorruptVolume, volume.Name)
+		}
+		s.current++
+		s.digester = nil
+		if n > 0 {
+			return n, nil
+		}
+	}
+	return 0, io.EOF
+}
+
+// diagnose looks for the corrupt volume behind err, a failure to read the
+// tarball sequentially, by reading the remaining volumes. Returns err as is
+// if the tarball is not split or if no corrupt volume is found.
+func (s *volumeSet) diagnose(err error) error {
+	if len(s.volumes) == 0 || s.volumes[0].Digest == "" {
+		return err
+	}
+	if _, verr := io.Copy(io.Discard, s); errors.Is(verr, ErrCorruptVolume) {
+		return fmt.Errorf("%w: %w", verr, err)
+	}
+	return err
+}
+
+// ReadAt reads len(p) bytes starting at offset off, crossing volume
+// boundaries as needed.
+func (s *volumeSet) ReadAt(p []byte, off int64) (int, error) {
+	var total int
+	for len(p) > 0 {
+		if off >= s.size {
+			return total, io.EOF
+		}
+		idx := sort.Search(len(s.offsets), func(i int) bool { return s.offsets[i] > off }) - 1
+		local := off - s.offsets[idx]
+		chunk := p[:min(int64(len(p)), s.volumes[idx].Size-local)]
+		n, err := s.files[idx].ReadAt(chunk, local)
+		total += n
+		off += int64(n)
+		p = p[n:]
+		if err != nil && err != io.EOF {
+			return total, err
+		}
+		if n < len(chunk) {
+			return total, io.ErrUnexpectedEOF
+		}
+	}
+	return total, nil
+}
+
+// Close closes all volumes.
+func (s *volumeSet) Close() error {
+	var errs []error
+	for _, fp := range s.files {
+		errs = append(errs, fp.Close())
+	}
+	return errors.Join(errs...)
+}